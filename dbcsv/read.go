@@ -3,10 +3,12 @@
 package dbcsv
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"context"
 	"encoding/csv"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +17,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"golang.org/x/text/encoding"
@@ -71,8 +74,13 @@ func DetectReaderType(r io.Reader, fileName string) (FileType, error) {
 }
 
 type Config struct {
-	typ           FileType
-	Sheet, Skip   int
+	typ         FileType
+	Sheet, Skip int
+	// SheetName, when not empty, selects a sheet by name instead of by
+	// Sheet index; for an xlsx file ReadRows returns an error wrapping
+	// UnknownSheet if the selected sheet does not exist. Xls files ignore
+	// SheetName and are always read by Sheet index.
+	SheetName     string
 	Delim         string
 	Charset       string
 	ColumnsString string
@@ -158,7 +166,7 @@ func (cfg *Config) ReadRows(ctx context.Context, fn func(string, Row) error, fil
 	case Xls:
 		return ReadXLSFile(ctx, fn, fileName, cfg.Charset, cfg.Sheet, columns, cfg.Skip)
 	case XlsX:
-		return ReadXLSXFile(ctx, fn, fileName, cfg.Sheet, columns, cfg.Skip)
+		return ReadXLSXFile(ctx, fn, fileName, cfg.Sheet, cfg.SheetName, columns, cfg.Skip)
 	}
 	enc, err := cfg.Encoding()
 	if err != nil {
@@ -178,7 +186,50 @@ const (
 	DateTimeFormat = "20060102150405"
 )
 
-func ReadXLSXFile(ctx context.Context, fn func(string, Row) error, filename string, sheetIndex int, columns []int, skip int) error {
+// SheetNames returns the names of every sheet in fileName, in workbook
+// order, so callers can let users pick a Config.SheetName before reading.
+func SheetNames(fileName string) ([]string, error) {
+	xlFile, err := excelize.OpenFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", fileName)
+	}
+	var names []string
+	for i := 0; ; i++ {
+		name := xlFile.GetSheetName(i)
+		if name == "" {
+			break
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func resolveSheetName(xlFile *excelize.File, sheetIndex int, sheetName string) (string, error) {
+	if sheetName != "" {
+		for i := 0; ; i++ {
+			name := xlFile.GetSheetName(i)
+			if name == "" {
+				break
+			}
+			if name == sheetName {
+				return name, nil
+			}
+		}
+		return "", errors.Wrap(UnknownSheet, sheetName)
+	}
+	name := xlFile.GetSheetName(sheetIndex)
+	if name == "" {
+		return "", errors.Wrap(UnknownSheet, strconv.Itoa(sheetIndex))
+	}
+	return name, nil
+}
+
+// ReadXLSXFile reads sheet sheetName (if non-empty) or sheet sheetIndex of
+// filename, row by row, using excelize's streaming row iterator so the
+// whole sheet is never held in memory at once. Each returned Row carries
+// typed Cells instead of plain strings, so dates and numbers survive the
+// round trip instead of turning into formatted or truncated strings.
+func ReadXLSXFile(ctx context.Context, fn func(string, Row) error, filename string, sheetIndex int, sheetName string, columns []int, skip int) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
@@ -186,11 +237,22 @@ func ReadXLSXFile(ctx context.Context, fn func(string, Row) error, filename stri
 	if err != nil {
 		return errors.Wrapf(err, "open %q", filename)
 	}
-	sheetName := xlFile.GetSheetName(sheetIndex)
-	if sheetName == "" {
-		return errors.Wrap(UnknownSheet, strconv.Itoa(sheetIndex))
+	sheetName, err = resolveSheetName(xlFile, sheetIndex, sheetName)
+	if err != nil {
+		return err
 	}
-	n := 0
+
+	rows, err := xlFile.Rows(sheetName)
+	if err != nil {
+		return errors.Wrapf(err, "rows of %q", sheetName)
+	}
+
+	meta, err := newSheetMetaReader(filename, sheetName)
+	if err != nil {
+		return errors.Wrapf(err, "sheet metadata of %q", sheetName)
+	}
+	defer meta.Close()
+
 	var need map[int]bool
 	if len(columns) != 0 {
 		need = make(map[int]bool, len(columns))
@@ -198,11 +260,15 @@ func ReadXLSXFile(ctx context.Context, fn func(string, Row) error, filename stri
 			need[i] = true
 		}
 	}
-	for i, row := range xlFile.GetRows(sheetName) {
-		if i < skip {
-			continue
+
+	n, i := 0, -1
+	for rows.Next() {
+		i++
+		rowMeta, metaErr := meta.next()
+		if metaErr != nil && metaErr != io.EOF {
+			return errors.Wrapf(metaErr, "sheet metadata of %s:%d", sheetName, i)
 		}
-		if row == nil {
+		if i < skip {
 			continue
 		}
 		select {
@@ -210,14 +276,327 @@ func ReadXLSXFile(ctx context.Context, fn func(string, Row) error, filename stri
 			return ctx.Err()
 		default:
 		}
-		if err := fn(sheetName, Row{Line: n, Values: row}); err != nil {
+		values, rowErr := rows.Columns()
+		if rowErr != nil {
+			return errors.Wrapf(rowErr, "%s:%d", sheetName, i)
+		}
+		if values == nil {
+			continue
+		}
+		cells := make([]Cell, 0, len(values))
+		for j, v := range values {
+			if need != nil && !need[j] {
+				cells = append(cells, Cell{})
+				continue
+			}
+			cells = append(cells, detectCell(xlFile, rowMeta[j], v))
+		}
+		if err := fn(sheetName, Row{Line: n, Cells: cells}); err != nil {
 			return err
 		}
 		n++
 	}
+	return rows.Error()
+}
+
+// builtin numFmtId ranges reserved for dates/times by ECMA-376 18.8.30.
+func isBuiltinDateFormat(id int) bool {
+	return (id >= 14 && id <= 22) || (id >= 45 && id <= 47)
+}
+
+func isCustomDateFormat(format string) bool {
+	for _, r := range format {
+		switch r {
+		case 'y', 'Y', 'm', 'M', 'd', 'D', 'h', 'H', 's', 'S':
+			return true
+		}
+	}
+	return false
+}
+
+// excelErrorValues are the error values Excel can store as a cell's value.
+var excelErrorValues = map[string]bool{
+	"#NULL!": true, "#DIV/0!": true, "#VALUE!": true, "#REF!": true,
+	"#NAME?": true, "#NUM!": true, "#N/A": true, "#GETTING_DATA": true,
+}
+
+// detectCell classifies raw, the value excelize computed for the cell meta
+// describes, as an Error, Formula, Date, Bool, Number or plain String cell.
+func detectCell(xlFile *excelize.File, meta cellMeta, raw string) Cell {
+	if excelErrorValues[raw] {
+		return Cell{Raw: raw, Type: ErrorCell}
+	}
+	if meta.formula != "" {
+		return Cell{Raw: raw, Type: FormulaCell, Formula: meta.formula}
+	}
+	if raw == "TRUE" || raw == "FALSE" {
+		return Cell{Raw: raw, Type: BoolCell, Bool: raw == "TRUE"}
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		if isDateCell(xlFile, meta.styleID) {
+			return Cell{Raw: raw, Type: DateCell, Date: excelDateToTime(f)}
+		}
+		return Cell{Raw: raw, Type: NumberCell, Number: f}
+	}
+	return stringCell(raw)
+}
+
+func isDateCell(xlFile *excelize.File, styleID int) bool {
+	if xlFile.Styles == nil || xlFile.Styles.CellXfs == nil {
+		return false
+	}
+	xfs := xlFile.Styles.CellXfs.Xf
+	if styleID < 0 || styleID >= len(xfs) || xfs[styleID].NumFmtID == nil {
+		return false
+	}
+	id := *xfs[styleID].NumFmtID
+	if isBuiltinDateFormat(id) {
+		return true
+	}
+	if xlFile.Styles.NumFmts == nil {
+		return false
+	}
+	for _, nf := range xlFile.Styles.NumFmts.NumFmt {
+		if nf.NumFmtID == id {
+			return isCustomDateFormat(nf.FormatCode)
+		}
+	}
+	return false
+}
+
+// cellMeta holds the per-cell metadata sheetMetaReader pulls off a
+// worksheet's raw XML: its style index (the <c s="..."> attribute) and,
+// if present, its formula (the <c><f>...</f></c> child). The zero value
+// describes a cell with the default style and no formula.
+type cellMeta struct {
+	styleID int
+	formula string
+}
+
+// sheetMetaReader streams cellMeta straight out of a worksheet's raw XML,
+// one <row> at a time, so ReadXLSXFile can get formula/style data without
+// calling excelize's GetCellFormula/GetCellStyle: in this excelize version
+// those force a full in-memory parse of the sheet on first use, which
+// defeats the bounded-memory streaming ReadXLSXFile otherwise gets from
+// xlFile.Rows.
+type sheetMetaReader struct {
+	zrc *zip.ReadCloser
+	rc  io.ReadCloser
+	dec *xml.Decoder
+}
+
+func newSheetMetaReader(filename, sheetName string) (*sheetMetaReader, error) {
+	zrc, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	part, err := worksheetPart(&zrc.Reader, sheetName)
+	if err != nil {
+		zrc.Close()
+		return nil, err
+	}
+	f := findZipFile(&zrc.Reader, part)
+	if f == nil {
+		zrc.Close()
+		return nil, fmt.Errorf("worksheet part %q not found", part)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		zrc.Close()
+		return nil, err
+	}
+	return &sheetMetaReader{zrc: zrc, rc: rc, dec: xml.NewDecoder(rc)}, nil
+}
+
+func (m *sheetMetaReader) Close() error {
+	rcErr := m.rc.Close()
+	if zrcErr := m.zrc.Close(); zrcErr != nil && rcErr == nil {
+		rcErr = zrcErr
+	}
+	return rcErr
+}
+
+// next scans forward to the next <row> and returns its cells' metadata,
+// keyed by the same 0-based column index excelize.Rows.Columns() uses. It
+// returns io.EOF once sheetData is exhausted, in lockstep with the last
+// xlFile.Rows.Next() call returning false.
+func (m *sheetMetaReader) next() (map[int]cellMeta, error) {
+	for {
+		tok, err := m.dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		return m.readRow()
+	}
+}
+
+func (m *sheetMetaReader) readRow() (map[int]cellMeta, error) {
+	cells := make(map[int]cellMeta)
+	for {
+		tok, err := m.dec.Token()
+		if err != nil {
+			return cells, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				if err := m.dec.Skip(); err != nil {
+					return cells, err
+				}
+				continue
+			}
+			col, meta, err := m.readCell(t)
+			if err != nil {
+				return cells, err
+			}
+			if col >= 0 {
+				cells[col] = meta
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				return cells, nil
+			}
+		}
+	}
+}
+
+func (m *sheetMetaReader) readCell(c xml.StartElement) (col int, meta cellMeta, err error) {
+	col = -1
+	for _, a := range c.Attr {
+		switch a.Name.Local {
+		case "r":
+			if colIdx, _, cerr := excelize.CellNameToCoordinates(a.Value); cerr == nil {
+				col = colIdx - 1
+			}
+		case "s":
+			meta.styleID, _ = strconv.Atoi(a.Value)
+		}
+	}
+	for {
+		tok, terr := m.dec.Token()
+		if terr != nil {
+			return col, meta, terr
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "f" {
+				var f string
+				if derr := m.dec.DecodeElement(&f, &t); derr != nil {
+					return col, meta, derr
+				}
+				meta.formula = f
+			} else if err := m.dec.Skip(); err != nil {
+				return col, meta, err
+			}
+		case xml.EndElement:
+			if t.Name.Local == "c" {
+				return col, meta, nil
+			}
+		}
+	}
+}
+
+// workbookXML is the subset of xl/workbook.xml worksheetPart needs: the
+// sheet name to relationship ID mapping.
+type workbookXML struct {
+	Sheets struct {
+		Sheet []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheet"`
+	} `xml:"sheets"`
+}
+
+// relationshipsXML is the subset of xl/_rels/workbook.xml.rels
+// worksheetPart needs: relationship ID to part path.
+type relationshipsXML struct {
+	Relationship []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// worksheetPart resolves sheetName to its zip entry name (e.g.
+// "xl/worksheets/sheet1.xml") by following xl/workbook.xml's sheet list to
+// a relationship ID, then xl/_rels/workbook.xml.rels' target for that ID.
+func worksheetPart(zr *zip.Reader, sheetName string) (string, error) {
+	f := findZipFile(zr, "xl/workbook.xml")
+	if f == nil {
+		return "", fmt.Errorf("xl/workbook.xml not found")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	var wb workbookXML
+	err = xml.NewDecoder(rc).Decode(&wb)
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	var rID string
+	for _, s := range wb.Sheets.Sheet {
+		if s.Name == sheetName {
+			rID = s.RID
+			break
+		}
+	}
+	if rID == "" {
+		return "", errors.Wrap(UnknownSheet, sheetName)
+	}
+
+	f = findZipFile(zr, "xl/_rels/workbook.xml.rels")
+	if f == nil {
+		return "", fmt.Errorf("xl/_rels/workbook.xml.rels not found")
+	}
+	rc, err = f.Open()
+	if err != nil {
+		return "", err
+	}
+	var rels relationshipsXML
+	err = xml.NewDecoder(rc).Decode(&rels)
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range rels.Relationship {
+		if r.ID == rID {
+			return "xl/" + strings.TrimPrefix(r.Target, "/"), nil
+		}
+	}
+	return "", fmt.Errorf("relationship %q not found", rID)
+}
+
+func findZipFile(zr *zip.Reader, name string) *zip.File {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
 	return nil
 }
 
+// excelDateToTime decodes an Excel 1900-date-system serial number into a
+// time.Time, rounded to the nearest second. The well-known Dec 30 1899
+// epoch compensates for Excel's (incorrect) belief that 1900 was a leap
+// year: serials from 61 (1 March 1900) on decode to the date Excel shows,
+// earlier ones come out one day early. Workbooks using the
+// 1904 date system aren't detected separately and are decoded as if 1900,
+// which this package's excelize version doesn't expose a way to tell apart.
+func excelDateToTime(serial float64) time.Time {
+	epoch := time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+	days := int(serial)
+	frac := serial - float64(days)
+	return epoch.AddDate(0, 0, days).Add(time.Duration(frac*24*float64(time.Hour) + 0.5*float64(time.Second))).Truncate(time.Second)
+}
+
 func ReadXLSFile(ctx context.Context, fn func(string, Row) error, filename string, charset string, sheetIndex int, columns []int, skip int) error {
 	if err := ctx.Err(); err != nil {
 		return err
@@ -267,7 +646,11 @@ func ReadXLSFile(ctx context.Context, fn func(string, Row) error, filename strin
 			return ctx.Err()
 		default:
 		}
-		if err := fn(sheet.Name, Row{Line: int(n), Values: vals}); err != nil {
+		cells := make([]Cell, len(vals))
+		for i, v := range vals {
+			cells[i] = stringCell(v)
+		}
+		if err := fn(sheet.Name, Row{Line: int(n), Cells: cells}); err != nil {
 			return err
 		}
 	}
@@ -331,7 +714,11 @@ func ReadCSV(ctx context.Context, fn func(Row) error, r io.Reader, delim string,
 		case <-ctx.Done():
 			return ctx.Err()
 		}
-		if err := fn(Row{Line: n - 1, Values: row}); err != nil {
+		cells := make([]Cell, len(row))
+		for i, v := range row {
+			cells[i] = stringCell(v)
+		}
+		if err := fn(Row{Line: n - 1, Cells: cells}); err != nil {
 			return err
 		}
 	}
@@ -339,8 +726,36 @@ func ReadCSV(ctx context.Context, fn func(Row) error, r io.Reader, delim string,
 }
 
 type Row struct {
-	Line   int
-	Values []string
+	Line  int
+	Cells []Cell
 }
 
+// CellType classifies the value a Cell holds, as detected from the
+// underlying source (only ever String for CSV and the legacy xls reader,
+// which don't carry type information).
+type CellType string
+
+const (
+	UnknownCell CellType = ""
+	StringCell  CellType = "String"
+	NumberCell  CellType = "Number"
+	BoolCell    CellType = "Bool"
+	DateCell    CellType = "Date"
+	FormulaCell CellType = "Formula"
+	ErrorCell   CellType = "Error"
+)
+
+// Cell is one cell of a Row. Raw always holds the original string form;
+// the other fields are populated according to Type.
+type Cell struct {
+	Raw     string
+	Type    CellType
+	Number  float64
+	Bool    bool
+	Date    time.Time
+	Formula string
+}
+
+func stringCell(s string) Cell { return Cell{Raw: s, Type: StringCell} }
+
 // vim: set noet fileencoding=utf-8:
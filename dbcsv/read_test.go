@@ -0,0 +1,70 @@
+// Copyright 2017 Tamás Gulácsi. All rights reserved.
+
+package dbcsv
+
+import (
+	"testing"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+)
+
+func TestIsBuiltinDateFormat(t *testing.T) {
+	for _, id := range []int{14, 17, 22, 45, 46, 47} {
+		if !isBuiltinDateFormat(id) {
+			t.Errorf("isBuiltinDateFormat(%d) = false, want true", id)
+		}
+	}
+	for _, id := range []int{0, 1, 13, 23, 44, 48} {
+		if isBuiltinDateFormat(id) {
+			t.Errorf("isBuiltinDateFormat(%d) = true, want false", id)
+		}
+	}
+}
+
+func TestDetectCellError(t *testing.T) {
+	c := detectCell(&excelize.File{}, cellMeta{}, "#N/A")
+	if c.Type != ErrorCell {
+		t.Errorf("Type = %q, want ErrorCell", c.Type)
+	}
+}
+
+func TestDetectCellFormula(t *testing.T) {
+	c := detectCell(&excelize.File{}, cellMeta{formula: "A1+A2"}, "3")
+	if c.Type != FormulaCell {
+		t.Errorf("Type = %q, want FormulaCell", c.Type)
+	}
+	if c.Formula != "A1+A2" {
+		t.Errorf("Formula = %q, want \"A1+A2\"", c.Formula)
+	}
+}
+
+func TestDetectCellBool(t *testing.T) {
+	c := detectCell(&excelize.File{}, cellMeta{}, "TRUE")
+	if c.Type != BoolCell || !c.Bool {
+		t.Errorf("got %+v, want a true BoolCell", c)
+	}
+	c = detectCell(&excelize.File{}, cellMeta{}, "FALSE")
+	if c.Type != BoolCell || c.Bool {
+		t.Errorf("got %+v, want a false BoolCell", c)
+	}
+}
+
+func TestDetectCellNumber(t *testing.T) {
+	c := detectCell(&excelize.File{}, cellMeta{}, "123.5")
+	if c.Type != NumberCell {
+		t.Errorf("Type = %q, want NumberCell", c.Type)
+	}
+	if c.Number != 123.5 {
+		t.Errorf("Number = %v, want 123.5", c.Number)
+	}
+}
+
+func TestDetectCellString(t *testing.T) {
+	c := detectCell(&excelize.File{}, cellMeta{}, "hello")
+	if c.Type != StringCell {
+		t.Errorf("Type = %q, want StringCell", c.Type)
+	}
+	if c.Raw != "hello" {
+		t.Errorf("Raw = %q, want \"hello\"", c.Raw)
+	}
+}
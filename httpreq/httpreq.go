@@ -25,17 +25,60 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/golang/glog"
-
-	"github.com/tgulacsi/go/temp"
+	"github.com/spf13/afero"
 )
 
+// Handler reads and writes uploaded files through an afero.Fs, so callers
+// can inject an in-memory FS for tests, a BasePathFs for chroot-style
+// isolation, or an S3-backed FS in production, instead of always hitting
+// local disk. Saved files and SendFile go through Fs; the multipart parsing
+// done by ReadOneFile and ReadFiles does not, and spills parts larger than
+// 1 MiB to temporary files on local disk.
+type Handler struct {
+	Fs afero.Fs
+
+	// MaxSize limits how many bytes are read from a single uploaded part,
+	// by both ReadOneFile and ReadFiles. 0 means unlimited.
+	MaxSize int64
+}
+
+// NewHandler returns a Handler backed by fs.
+func NewHandler(fs afero.Fs) *Handler {
+	return &Handler{Fs: fs}
+}
+
+var defaultHandler = NewHandler(afero.NewOsFs())
+
 // ReadRequestOneFile reads the first file from the request (if multipart/),
-// or returns the body if not
+// or returns the body if not. It is a thin wrapper around the default,
+// OS-backed Handler's ReadOneFile.
 func ReadRequestOneFile(r *http.Request) (body io.ReadCloser, contentType string, status int, err error) {
+	return defaultHandler.ReadOneFile(r)
+}
+
+// ReadRequestFiles reads the files from the request and saves them. It is
+// a thin wrapper around the default, OS-backed Handler's ReadFiles.
+func ReadRequestFiles(r *http.Request) (filenames []string, status int, err error) {
+	return defaultHandler.ReadFiles(r)
+}
+
+// SendFile sends the given file as response. It is a thin wrapper around
+// the default, OS-backed Handler's SendFile.
+func SendFile(w http.ResponseWriter, filename, contentType string) error {
+	return defaultHandler.SendFile(w, filename, contentType)
+}
+
+// ReadOneFile reads the first file from the request (if multipart/), or
+// returns the body if not. A non-multipart body is returned unread. A
+// multipart request is first parsed whole with ParseMultipartForm, which
+// keeps up to 1 MiB in memory and spills the rest to temporary files on
+// local disk; the returned ReadCloser then reads the chosen part from
+// there, not from the network. Parts are not streamed one by one.
+func (h *Handler) ReadOneFile(r *http.Request) (body io.ReadCloser, contentType string, status int, err error) {
 	body = r.Body
 	contentType = r.Header.Get("Content-Type")
 	glog.Infof("ct=%q", contentType)
@@ -58,10 +101,15 @@ func ReadRequestOneFile(r *http.Request) (body io.ReadCloser, contentType string
 Outer:
 	for _, fileHeaders := range r.MultipartForm.File {
 		for _, fileHeader := range fileHeaders {
-			if body, err = fileHeader.Open(); err != nil {
+			var part multipart.File
+			if part, err = fileHeader.Open(); err != nil {
 				status, err = 405, fmt.Errorf("error opening part %q: %s", fileHeader.Filename, err)
 				return
 			}
+			body = part
+			if h.MaxSize > 0 {
+				body = limitedReadCloser{&maxSizeReader{r: part, max: h.MaxSize}, part}
+			}
 			contentType = fileHeader.Header.Get("Content-Type")
 			break Outer
 		}
@@ -70,8 +118,9 @@ Outer:
 	return
 }
 
-// ReadRequestFiles reads the files from the request, and calls ReaderToFile on them
-func ReadRequestFiles(r *http.Request) (filenames []string, status int, err error) {
+// ReadFiles reads the files from the request, streaming each part into a
+// file on h.Fs, and returns their names.
+func (h *Handler) ReadFiles(r *http.Request) (filenames []string, status int, err error) {
 	defer r.Body.Close()
 	err = r.ParseMultipartForm(1 << 20)
 	if err != nil {
@@ -93,8 +142,16 @@ func ReadRequestFiles(r *http.Request) (filenames []string, status int, err erro
 				return
 			}
 			glog.V(1).Infof("part filename=%q", fileHeader.Filename)
-			if fn, err = temp.ReaderToFile(f, fileHeader.Filename, ""); err != nil {
+			var part io.Reader = f
+			if h.MaxSize > 0 {
+				part = &maxSizeReader{r: f, max: h.MaxSize}
+			}
+			if fn, err = saveToFs(h.Fs, part, fileHeader.Filename); err != nil {
 				f.Close()
+				if err == ErrMaxSizeExceeded {
+					status, err = 413, fmt.Errorf("%q exceeds MaxSize of %d bytes", fileHeader.Filename, h.MaxSize)
+					return
+				}
 				status, err = 500, fmt.Errorf("error saving %q: %s", fileHeader.Filename, err)
 				return
 			}
@@ -110,9 +167,9 @@ func ReadRequestFiles(r *http.Request) (filenames []string, status int, err erro
 	return
 }
 
-// SendFile sends the given file as response
-func SendFile(w http.ResponseWriter, filename, contentType string) error {
-	fh, err := os.Open(filename)
+// SendFile sends the given file as response.
+func (h *Handler) SendFile(w http.ResponseWriter, filename, contentType string) error {
+	fh, err := h.Fs.Open(filename)
 	if err != nil {
 		return err
 	}
@@ -123,7 +180,7 @@ func SendFile(w http.ResponseWriter, filename, contentType string) error {
 	}
 	size := fi.Size()
 	if _, err = fh.Seek(0, 0); err != nil {
-		err = fmt.Errorf("error seeking in %s: %s", fh, err)
+		err = fmt.Errorf("error seeking in %s: %s", fh.Name(), err)
 		http.Error(w, err.Error(), 500)
 		return err
 	}
@@ -140,3 +197,64 @@ func SendFile(w http.ResponseWriter, filename, contentType string) error {
 	}
 	return err
 }
+
+// saveToFs streams r into a new temporary file on fs, named after base,
+// and returns the file's name.
+func saveToFs(fs afero.Fs, r io.Reader, base string) (string, error) {
+	pattern := fmt.Sprintf("%s-*%s", strings.TrimSuffix(filepath.Base(base), filepath.Ext(base)), filepath.Ext(base))
+	fh, err := afero.TempFile(fs, "", pattern)
+	if err != nil {
+		return "", err
+	}
+	name := fh.Name()
+	_, err = io.Copy(fh, r)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// limitedReadCloser pairs a size-limited Reader with the Closer of the
+// underlying, unlimited stream.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ErrMaxSizeExceeded is returned once a part read through a maxSizeReader
+// turns out to hold more than Handler.MaxSize bytes.
+var ErrMaxSizeExceeded = errors.New("httpreq: part exceeds MaxSize")
+
+// maxSizeReader wraps r so that Read returns ErrMaxSizeExceeded instead of
+// silently stopping once more than max bytes have come through it, unlike
+// a bare io.LimitReader, which just hands back a truncated prefix as if it
+// were the whole part.
+type maxSizeReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n > m.max {
+		return 0, ErrMaxSizeExceeded
+	}
+	if limit := m.max + 1 - m.n; int64(len(p)) > limit {
+		p = p[:limit]
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		// Even if r returned its final bytes together with a non-nil
+		// error (legal per io.Reader, and common for e.g. io.EOF on the
+		// last read), the overflow must win: otherwise io.Copy treats
+		// this as a clean finish and a part of exactly max+1 bytes would
+		// slip through undetected.
+		return n, ErrMaxSizeExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,85 @@
+/*
+  Copyright 2013 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package httpreq
+
+import (
+	"io"
+	"testing"
+)
+
+// eofWithData returns its remaining bytes together with io.EOF in the same
+// Read call, instead of a clean 0-byte EOF on the following call - legal
+// per io.Reader, and the case maxSizeReader.Read must still catch.
+type eofWithData struct {
+	data []byte
+}
+
+func (r *eofWithData) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, io.EOF
+}
+
+func TestMaxSizeReaderUnderLimit(t *testing.T) {
+	r := &maxSizeReader{r: &eofWithData{data: []byte("hello")}, max: 10}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want \"hello\"", got)
+	}
+}
+
+func TestMaxSizeReaderExactlyAtLimit(t *testing.T) {
+	r := &maxSizeReader{r: &eofWithData{data: []byte("hello")}, max: 5}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want \"hello\"", got)
+	}
+}
+
+// TestMaxSizeReaderOverLimitWithSimultaneousEOF is the case the off-by-one
+// fix targets: the wrapped reader returns its final, over-limit bytes
+// together with io.EOF in one call, not a separate clean-EOF call after.
+func TestMaxSizeReaderOverLimitWithSimultaneousEOF(t *testing.T) {
+	r := &maxSizeReader{r: &eofWithData{data: []byte("hello")}, max: 4}
+	_, err := io.ReadAll(r)
+	if err != ErrMaxSizeExceeded {
+		t.Fatalf("ReadAll error = %v, want ErrMaxSizeExceeded", err)
+	}
+}
+
+func TestMaxSizeReaderOverLimitSeparateEOF(t *testing.T) {
+	r := &maxSizeReader{r: io.LimitReader(onesReader{}, 100), max: 4}
+	_, err := io.ReadAll(r)
+	if err != ErrMaxSizeExceeded {
+		t.Fatalf("ReadAll error = %v, want ErrMaxSizeExceeded", err)
+	}
+}
+
+type onesReader struct{}
+
+func (onesReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 1
+	}
+	return len(p), nil
+}
@@ -0,0 +1,180 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/nathankerr/pdf"
+)
+
+// MergeResult reports what MergeFilesWithOptions did, beyond writing dest.
+type MergeResult struct {
+	// ObjectsDeduped is the number of objects that turned out to be a
+	// byte-for-byte duplicate (after decoding) of one already written to
+	// dest, and so were reused instead of added again. Always 0 unless
+	// MergeOptions.Dedup is set.
+	ObjectsDeduped int
+	// BytesSaved is the encoded size of the objects ObjectsDeduped counts,
+	// i.e. roughly how much smaller dest is than a MergeFiles run on the
+	// same sources would have produced.
+	BytesSaved int64
+}
+
+// deduper reuses previously-added dictionaries and streams that hash to
+// the same content, so that e.g. a font or ICC profile embedded in every
+// source of a merge is only stored once in dest.
+type deduper struct {
+	byHash map[[sha256.Size]byte]pdf.ObjectReference
+	result MergeResult
+}
+
+func newDeduper() *deduper {
+	return &deduper{byHash: make(map[[sha256.Size]byte]pdf.ObjectReference)}
+}
+
+// addOrReuse adds obj to dst under ref, unless an object with the same
+// canonical hash was already added, in which case the existing reference
+// is returned and ref is left as an orphaned Null placeholder in dst. When
+// outHandler is non-nil, a genuinely new obj is encrypted (keyed by ref)
+// before being written, after hashing - ciphertext is per-object-number and
+// so would never hash equal across sources even for identical plaintext.
+func (d *deduper) addOrReuse(dst *pdf.File, ref pdf.ObjectReference, obj pdf.Object, outHandler *outputSecurityHandler) (pdf.ObjectReference, error) {
+	hash, size, hashable := canonicalHashAndSize(obj)
+	if hashable {
+		if existing, ok := d.byHash[hash]; ok {
+			d.result.ObjectsDeduped++
+			d.result.BytesSaved += size
+			return existing, nil
+		}
+	}
+	if outHandler != nil {
+		var err error
+		if obj, err = encryptObject(outHandler, ref.Number, ref.Generation, obj); err != nil {
+			return ref, fmt.Errorf("encrypt %d %d obj: %v", ref.Number, ref.Generation, err)
+		}
+	}
+	newRef, err := dst.Add(pdf.IndirectObject{ObjectReference: ref, Object: obj})
+	if err != nil {
+		return newRef, err
+	}
+	if hashable {
+		d.byHash[hash] = newRef
+	}
+	return newRef, nil
+}
+
+// canonicalHashAndSize canonicalizes obj once and returns both a SHA-256
+// digest over that serialization (dictionary keys sorted, stream bytes
+// inflated before hashing so the same image re-compressed at a different
+// zlib level still dedupes) and an approximation of obj's encoded size for
+// MergeResult.BytesSaved: the length of its still-encoded stream data for a
+// stream, the length of that serialization for anything else. By the time
+// obj reaches here its own indirect references have already been resolved and deduped by the
+// caller's post-order recursion, so a nested pdf.ObjectReference is encoded
+// as part of the canonical form rather than making obj unhashable; it
+// reports hashable=false only for objects writeCanonical can't handle at
+// all, in which case the caller must not attempt to dedupe them.
+func canonicalHashAndSize(obj pdf.Object) (hash [sha256.Size]byte, size int64, hashable bool) {
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, obj); err != nil {
+		return hash, 0, false
+	}
+	if s, ok := obj.(pdf.Stream); ok {
+		size = int64(len(s.Stream))
+	} else {
+		size = int64(buf.Len())
+	}
+	return sha256.Sum256(buf.Bytes()), size, true
+}
+
+func writeCanonical(buf *bytes.Buffer, obj pdf.Object) error {
+	switch t := obj.(type) {
+	case pdf.Dictionary:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('<')
+		for _, k := range keys {
+			buf.WriteString(k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, t[k]); err != nil {
+				return err
+			}
+			buf.WriteByte(';')
+		}
+		buf.WriteByte('>')
+	case pdf.Array:
+		buf.WriteByte('[')
+		for _, v := range t {
+			if err := writeCanonical(buf, v); err != nil {
+				return err
+			}
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(']')
+	case pdf.Stream:
+		if err := writeCanonical(buf, t.Dictionary); err != nil {
+			return err
+		}
+		buf.WriteString("stream:")
+		buf.Write(decodedStreamBytes(t))
+	case pdf.Name:
+		fmt.Fprintf(buf, "/%s", string(t))
+	case pdf.String:
+		fmt.Fprintf(buf, "(%s)", string(t))
+	case pdf.Integer:
+		fmt.Fprintf(buf, "%d", int64(t))
+	case pdf.Real:
+		fmt.Fprintf(buf, "%g", float64(t))
+	case pdf.Null:
+		buf.WriteString("null")
+	case pdf.ObjectReference:
+		fmt.Fprintf(buf, "@%d %d", t.Number, t.Generation)
+	default:
+		return fmt.Errorf("unhandled %T in canonical hash", obj)
+	}
+	return nil
+}
+
+// decodedStreamBytes returns s's data with a single outer /FlateDecode
+// undone, so two streams holding the same content but compressed
+// differently still hash the same. Any other filter (or undecodable
+// data) is hashed as-is.
+func decodedStreamBytes(s pdf.Stream) []byte {
+	filter, _ := s.Dictionary["Filter"].(pdf.Name)
+	if filter != "FlateDecode" {
+		return s.Stream
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(s.Stream))
+	if err != nil {
+		return s.Stream
+	}
+	defer zr.Close()
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return s.Stream
+	}
+	return decoded
+}
@@ -0,0 +1,104 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"github.com/nathankerr/pdf"
+)
+
+func TestCanonicalHashAndSizeDictKeyOrderIndependent(t *testing.T) {
+	a := pdf.Dictionary{"A": pdf.Integer(1), "B": pdf.Name("X")}
+	b := pdf.Dictionary{"B": pdf.Name("X"), "A": pdf.Integer(1)}
+
+	ha, _, ok := canonicalHashAndSize(a)
+	if !ok {
+		t.Fatalf("a not hashable")
+	}
+	hb, _, ok := canonicalHashAndSize(b)
+	if !ok {
+		t.Fatalf("b not hashable")
+	}
+	if ha != hb {
+		t.Errorf("dictionaries with the same keys/values in different order hashed differently")
+	}
+}
+
+func TestCanonicalHashAndSizeDistinguishesContent(t *testing.T) {
+	a := pdf.Dictionary{"A": pdf.Integer(1)}
+	b := pdf.Dictionary{"A": pdf.Integer(2)}
+
+	ha, _, _ := canonicalHashAndSize(a)
+	hb, _, _ := canonicalHashAndSize(b)
+	if ha == hb {
+		t.Errorf("dictionaries with different values hashed the same")
+	}
+}
+
+func TestCanonicalHashAndSizeObjectReference(t *testing.T) {
+	a := pdf.Dictionary{"Parent": pdf.ObjectReference{Number: 5, Generation: 0}}
+	b := pdf.Dictionary{"Parent": pdf.ObjectReference{Number: 6, Generation: 0}}
+
+	ha, _, ok := canonicalHashAndSize(a)
+	if !ok {
+		t.Fatalf("dictionary holding an ObjectReference was reported unhashable")
+	}
+	hb, _, ok := canonicalHashAndSize(b)
+	if !ok {
+		t.Fatalf("dictionary holding an ObjectReference was reported unhashable")
+	}
+	if ha == hb {
+		t.Errorf("dictionaries referencing different objects hashed the same")
+	}
+}
+
+func TestCanonicalHashAndSizeFlateRecompression(t *testing.T) {
+	plain := []byte("the quick brown fox jumps over the lazy dog, repeated a bit for good measure")
+	s1 := pdf.Stream{Dictionary: pdf.Dictionary{"Filter": pdf.Name("FlateDecode")}, Stream: flateCompress(t, plain, 1)}
+	s2 := pdf.Stream{Dictionary: pdf.Dictionary{"Filter": pdf.Name("FlateDecode")}, Stream: flateCompress(t, plain, 9)}
+
+	h1, _, ok := canonicalHashAndSize(s1)
+	if !ok {
+		t.Fatalf("s1 not hashable")
+	}
+	h2, _, ok := canonicalHashAndSize(s2)
+	if !ok {
+		t.Fatalf("s2 not hashable")
+	}
+	if h1 != h2 {
+		t.Errorf("the same content, FlateDecode-compressed at different levels, hashed differently")
+	}
+}
+
+func flateCompress(t *testing.T, data []byte, level int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatalf("zlib.NewWriterLevel: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.Bytes()
+}
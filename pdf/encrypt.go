@@ -0,0 +1,531 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/nathankerr/pdf"
+)
+
+// The security handlers below work on github.com/nathankerr/pdf's object
+// model, the same one merge.go and dedup.go use; these aliases name its
+// types without the package qualifier.
+type (
+	Object     = pdf.Object
+	Dictionary = pdf.Dictionary
+	Array      = pdf.Array
+	Stream     = pdf.Stream
+	String     = pdf.String
+	Name       = pdf.Name
+	Integer    = pdf.Integer
+)
+
+// padBytes is the fixed 32-byte padding string from the standard security
+// handler (ISO 32000-1, 7.6.3.3), used to pad/truncate passwords shorter
+// than 32 bytes.
+var padBytes = []byte{
+	0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41,
+	0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08,
+	0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80,
+	0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A,
+}
+
+// securityHandler decrypts strings and streams belonging to a single PDF
+// file, per the standard security handler (/Filter /Standard).
+type securityHandler struct {
+	key     []byte
+	useAES  bool
+	rev     int // /R
+	version int // /V
+}
+
+// newSecurityHandler derives the file encryption key from the Encrypt
+// dictionary, the file ID and the (user) password, per Algorithm 2 of
+// ISO 32000-1 7.6.3.3. AES-256 (/V 5, ISO 32000-2) uses the newer,
+// unicode-password based Algorithm 2.A instead.
+func newSecurityHandler(encrypt Dictionary, id0 []byte, password string) (*securityHandler, error) {
+	v, _ := encrypt["V"].(Integer)
+	r, _ := encrypt["R"].(Integer)
+	lengthBits, ok := encrypt["Length"].(Integer)
+	if !ok {
+		lengthBits = 40
+	}
+	o, ok := encrypt["O"].(String)
+	if !ok {
+		return nil, fmt.Errorf("encrypt dict has no /O")
+	}
+	p, ok := encrypt["P"].(Integer)
+	if !ok {
+		return nil, fmt.Errorf("encrypt dict has no /P")
+	}
+
+	h := &securityHandler{rev: int(r), version: int(v)}
+
+	if v == 5 || r >= 5 {
+		// AES-256 (PDF 2.0 / ISO 32000-2): the key isn't derived with
+		// MD5/RC4 at all, it's unwrapped from /UE or /OE with a hash of
+		// the (UTF-8) password and a salt out of /U or /O.
+		ue, ok := encrypt["UE"].(String)
+		if !ok {
+			return nil, fmt.Errorf("encrypt dict has no /UE")
+		}
+		u, ok := encrypt["U"].(String)
+		if !ok || len(u) < 48 {
+			return nil, fmt.Errorf("encrypt dict has no usable /U")
+		}
+
+		var interKey []byte
+		switch {
+		case r == 5:
+			// The deprecated /R 5 scheme (never a published ISO standard):
+			// a single, unvalidated SHA-256 of the password and the /U key
+			// salt. Only the empty password is accepted here.
+			if password != "" {
+				return nil, fmt.Errorf("AES-256 (/R 5) with a non-empty password is not supported")
+			}
+			sum := sha256.Sum256([]byte(u[40:48]))
+			interKey = sum[:]
+		case r >= 6:
+			// ISO 32000-2 Algorithm 2.A: validate password against /U (the
+			// user password) or /O (the owner password, salted with the
+			// full /U string), each via the Algorithm 2.B hardened hash,
+			// then derive the intermediate key the same way but with the
+			// matching entry's key salt instead of its validation salt.
+			pw := []byte(password)
+			if bytes.Equal(hash2B(pw, []byte(u[32:40]), nil), []byte(u[:32])) {
+				interKey = hash2B(pw, []byte(u[40:48]), nil)
+			} else if o, ok := encrypt["O"].(String); ok && len(o) >= 48 &&
+				bytes.Equal(hash2B(pw, []byte(o[32:40]), []byte(u[:48])), []byte(o[:32])) {
+				interKey = hash2B(pw, []byte(o[40:48]), []byte(u[:48]))
+				if oe, ok := encrypt["OE"].(String); ok {
+					ue = oe
+				}
+			} else {
+				return nil, fmt.Errorf("password does not match /U or /O")
+			}
+		default:
+			return nil, fmt.Errorf("AES-256 with /R %d is not supported", r)
+		}
+
+		block, err := aes.NewCipher(interKey[:32])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		fileKey := make([]byte, len(ue))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(fileKey, []byte(ue))
+		h.key = fileKey
+		h.useAES = true
+		return h, nil
+	}
+
+	pw := make([]byte, 32)
+	n := copy(pw, []byte(password))
+	copy(pw[n:], padBytes)
+
+	m := md5.New()
+	m.Write(pw)
+	m.Write([]byte(o))
+	var pBytes [4]byte
+	pBytes[0] = byte(p)
+	pBytes[1] = byte(p >> 8)
+	pBytes[2] = byte(p >> 16)
+	pBytes[3] = byte(p >> 24)
+	m.Write(pBytes[:])
+	m.Write(id0)
+	key := m.Sum(nil)
+
+	keyLen := int(lengthBits) / 8
+	if keyLen <= 0 || keyLen > 16 {
+		keyLen = 5
+	}
+	if r >= 3 {
+		for i := 0; i < 50; i++ {
+			s := md5.Sum(key[:keyLen])
+			key = s[:]
+		}
+	}
+	h.key = key[:keyLen]
+
+	if cf, ok := encrypt["CF"].(Dictionary); ok {
+		if stmf, ok := encrypt["StmF"].(Name); ok && stmf != "Identity" {
+			if filt, ok := cf[string(stmf)].(Dictionary); ok {
+				if cfm, ok := filt["CFM"].(Name); ok {
+					h.useAES = cfm == "AESV2" || cfm == "AESV3"
+				}
+			}
+		}
+	}
+	return h, nil
+}
+
+// hash2B implements ISO 32000-2 Algorithm 2.B, the iterative "hardened
+// hash" /R 6 uses (instead of /R 5's single SHA-256) to both
+// validate a password against /U or /O and to derive the intermediate key
+// that unwraps /UE or /OE. udata is nil when hashing against /U, and the
+// 48-byte /U string when hashing against /O.
+func hash2B(password, salt, udata []byte) []byte {
+	input := make([]byte, 0, len(password)+len(salt)+len(udata))
+	input = append(input, password...)
+	input = append(input, salt...)
+	input = append(input, udata...)
+	sum := sha256.Sum256(input)
+	k := sum[:]
+
+	round := 0
+	for {
+		round++
+		k1 := make([]byte, 0, 64*(len(password)+len(k)+len(udata)))
+		for i := 0; i < 64; i++ {
+			k1 = append(k1, password...)
+			k1 = append(k1, k...)
+			k1 = append(k1, udata...)
+		}
+		block, err := aes.NewCipher(k[:16])
+		if err != nil {
+			return k[:32]
+		}
+		e := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+
+		sum := 0
+		for _, b := range e[:16] {
+			sum += int(b)
+		}
+		switch sum % 3 {
+		case 0:
+			s := sha256.Sum256(e)
+			k = s[:]
+		case 1:
+			s := sha512.Sum384(e)
+			k = s[:]
+		case 2:
+			s := sha512.Sum512(e)
+			k = s[:]
+		}
+		if round >= 64 && int(e[len(e)-1]) <= round-32 {
+			break
+		}
+	}
+	return k[:32]
+}
+
+// objectKey derives the per-object key used by RC4/AES-128 (not needed for
+// AES-256, which uses the file key directly), per Algorithm 1.
+func (h *securityHandler) objectKey(num, gen int) []byte {
+	if h.version >= 5 {
+		return h.key
+	}
+	m := md5.New()
+	m.Write(h.key)
+	m.Write([]byte{byte(num), byte(num >> 8), byte(num >> 16), byte(gen), byte(gen >> 8)})
+	if h.useAES {
+		m.Write([]byte{0x73, 0x41, 0x6c, 0x54}) // "sAlT"
+	}
+	sum := m.Sum(nil)
+	n := len(h.key) + 5
+	if n > 16 {
+		n = 16
+	}
+	return sum[:n]
+}
+
+// decrypt decrypts data belonging to object (num, gen) and returns the
+// plaintext in a newly allocated slice; data itself is left unchanged.
+func (h *securityHandler) decrypt(num, gen int, data []byte) ([]byte, error) {
+	key := h.objectKey(num, gen)
+	if !h.useAES {
+		c, err := rc4.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, len(data))
+		c.XORKeyStream(out, data)
+		return out, nil
+	}
+	if len(data) < aes.BlockSize {
+		return nil, fmt.Errorf("AES ciphertext too short")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv, ct := data[:aes.BlockSize], data[aes.BlockSize:]
+	if len(ct)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("AES ciphertext is not block-aligned")
+	}
+	out := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, ct)
+	// strip PKCS#7 padding
+	if n := len(out); n > 0 {
+		pad := int(out[n-1])
+		if pad > 0 && pad <= aes.BlockSize && pad <= n {
+			out = out[:n-pad]
+		}
+	}
+	return out, nil
+}
+
+// decryptObject walks obj, decrypting every String/Stream it finds in
+// place, using (num, gen) as the owning indirect object's identity.
+func decryptObject(h *securityHandler, num, gen int, obj Object) (Object, error) {
+	switch t := obj.(type) {
+	case String:
+		plain, err := h.decrypt(num, gen, []byte(t))
+		if err != nil {
+			return nil, err
+		}
+		return String(plain), nil
+	case Stream:
+		plain, err := h.decrypt(num, gen, t.Stream)
+		if err != nil {
+			return nil, err
+		}
+		t.Stream = plain
+		for k, v := range t.Dictionary {
+			nv, err := decryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t.Dictionary[k] = nv
+		}
+		return t, nil
+	case Dictionary:
+		for k, v := range t {
+			nv, err := decryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = nv
+		}
+		return t, nil
+	case Array:
+		for i, v := range t {
+			nv, err := decryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = nv
+		}
+		return t, nil
+	default:
+		return obj, nil
+	}
+}
+
+// isPDF20Encryption reports whether encrypt describes a PDF 2.0-only
+// (ISO 32000-2) encryption scheme: AES-256, i.e. /V 5 or /R 6. Paired with
+// usesCrossReferenceStreams, which covers the other structure
+// MergeFilesWithOptions treats the same way, a cross-reference stream
+// (itself a PDF 1.5+ structure, not a 2.0-only one). Either one
+// makes MergeFilesWithOptions log a one-time disclaimer when the merge
+// isn't targeting PDF 2.0 output.
+func isPDF20Encryption(encrypt Dictionary) bool {
+	if v, ok := encrypt["V"].(Integer); ok && v >= 5 {
+		return true
+	}
+	if r, ok := encrypt["R"].(Integer); ok && r >= 6 {
+		return true
+	}
+	return false
+}
+
+// outputSecurityHandler re-encrypts newly-written strings/streams with the
+// classic (/V 2 /R 3, RC4-128) standard security handler, using the same
+// password as both the user and the owner password. It's deliberately
+// narrower than securityHandler: MergeOptions.OutputPassword doesn't need
+// to reproduce every encryption flavor a source might have used, only give
+// MergeFilesWithOptions a straightforward way to not write unencrypted
+// output when asked not to.
+type outputSecurityHandler struct {
+	key []byte
+	o   []byte
+	u   []byte
+	id0 []byte
+}
+
+// permissionsAllowAll is the /P value written for output encryption: every
+// bit that ISO 32000-1 Table 22 reserves for a permission is set, since
+// MergeOptions.OutputPassword is about confidentiality at rest, not
+// restricting what a holder of the (single) password may do.
+const permissionsAllowAll = -4
+
+// newOutputSecurityHandler derives a file key and the /O, /U entries for
+// password (used as both user and owner password), per Algorithms 2, 3 and
+// 5 of ISO 32000-1 7.6.3.3, with a freshly generated file ID.
+func newOutputSecurityHandler(password string) (*outputSecurityHandler, error) {
+	id0 := make([]byte, 16)
+	if _, err := rand.Read(id0); err != nil {
+		return nil, err
+	}
+
+	pw := make([]byte, 32)
+	n := copy(pw, []byte(password))
+	copy(pw[n:], padBytes)
+
+	// /O (Algorithm 3): RC4-encrypt the padded user password with a key
+	// derived from the (here, identical) padded owner password.
+	ownerKey := md5.Sum(pw)
+	oc, err := rc4.NewCipher(ownerKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	o := make([]byte, 32)
+	oc.XORKeyStream(o, pw)
+
+	// Algorithm 2: the file encryption key.
+	m := md5.New()
+	m.Write(pw)
+	m.Write(o)
+	var pBytes [4]byte
+	perms := int32(permissionsAllowAll)
+	pBytes[0] = byte(perms)
+	pBytes[1] = byte(perms >> 8)
+	pBytes[2] = byte(perms >> 16)
+	pBytes[3] = byte(perms >> 24)
+	m.Write(pBytes[:])
+	m.Write(id0)
+	key := m.Sum(nil)
+	for i := 0; i < 50; i++ {
+		s := md5.Sum(key[:16])
+		key = s[:]
+	}
+	key = key[:16]
+
+	// /U (Algorithm 5, required for /R 3): MD5 of the padding string and
+	// the file ID, RC4-encrypted with the file key and then 19 more times
+	// with the key XORed against an increasing byte, padded out to 32
+	// bytes (only the first 16 are ever checked for /R >= 3).
+	h := md5.New()
+	h.Write(padBytes)
+	h.Write(id0)
+	u := h.Sum(nil)
+	uc, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	uc.XORKeyStream(u, u)
+	for i := byte(1); i <= 19; i++ {
+		xored := make([]byte, len(key))
+		for j := range key {
+			xored[j] = key[j] ^ i
+		}
+		xc, err := rc4.NewCipher(xored)
+		if err != nil {
+			return nil, err
+		}
+		xc.XORKeyStream(u, u)
+	}
+	uFull := make([]byte, 32)
+	copy(uFull, u)
+
+	return &outputSecurityHandler{key: key, o: o, u: uFull, id0: id0}, nil
+}
+
+// encryptDict returns the /Encrypt dictionary entries for h, to store in
+// the merged file's trailer.
+func (h *outputSecurityHandler) encryptDict() Dictionary {
+	return Dictionary{
+		"Filter": Name("Standard"),
+		"V":      Integer(2),
+		"R":      Integer(3),
+		"Length": Integer(128),
+		"O":      String(h.o),
+		"U":      String(h.u),
+		"P":      Integer(permissionsAllowAll),
+	}
+}
+
+// objectKey derives the per-object RC4-128 key, per Algorithm 1.
+func (h *outputSecurityHandler) objectKey(num, gen int) []byte {
+	m := md5.New()
+	m.Write(h.key)
+	m.Write([]byte{byte(num), byte(num >> 8), byte(num >> 16), byte(gen), byte(gen >> 8)})
+	sum := m.Sum(nil)
+	n := len(h.key) + 5
+	if n > 16 {
+		n = 16
+	}
+	return sum[:n]
+}
+
+func (h *outputSecurityHandler) encrypt(num, gen int, data []byte) ([]byte, error) {
+	c, err := rc4.NewCipher(h.objectKey(num, gen))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out, nil
+}
+
+// encryptObject walks obj, encrypting every String/Stream it finds in
+// place, using (num, gen) as the owning indirect object's identity. It is
+// the write-side mirror of decryptObject.
+func encryptObject(h *outputSecurityHandler, num, gen int, obj Object) (Object, error) {
+	switch t := obj.(type) {
+	case String:
+		enc, err := h.encrypt(num, gen, []byte(t))
+		if err != nil {
+			return nil, err
+		}
+		return String(enc), nil
+	case Stream:
+		enc, err := h.encrypt(num, gen, t.Stream)
+		if err != nil {
+			return nil, err
+		}
+		t.Stream = enc
+		for k, v := range t.Dictionary {
+			nv, err := encryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t.Dictionary[k] = nv
+		}
+		return t, nil
+	case Dictionary:
+		for k, v := range t {
+			nv, err := encryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = nv
+		}
+		return t, nil
+	case Array:
+		for i, v := range t {
+			nv, err := encryptObject(h, num, gen, v)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = nv
+		}
+		return t, nil
+	default:
+		return obj, nil
+	}
+}
@@ -0,0 +1,109 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nathankerr/pdf"
+)
+
+// TestOutputEncryptionRoundTrip checks that newSecurityHandler derives the
+// same file key newOutputSecurityHandler generated it from, by running a
+// string through encryptObject and back through decryptObject.
+func TestOutputEncryptionRoundTrip(t *testing.T) {
+	out, err := newOutputSecurityHandler("hunter2")
+	if err != nil {
+		t.Fatalf("newOutputSecurityHandler: %v", err)
+	}
+
+	want := pdf.String("a secret string, long enough to span more than one AES block")
+	enc, err := encryptObject(out, 7, 0, want)
+	if err != nil {
+		t.Fatalf("encryptObject: %v", err)
+	}
+	if enc.(pdf.String) == want {
+		t.Fatalf("encryptObject did not change the plaintext")
+	}
+
+	in, err := newSecurityHandler(out.encryptDict(), out.id0, "hunter2")
+	if err != nil {
+		t.Fatalf("newSecurityHandler: %v", err)
+	}
+	dec, err := decryptObject(in, 7, 0, enc)
+	if err != nil {
+		t.Fatalf("decryptObject: %v", err)
+	}
+	if dec.(pdf.String) != want {
+		t.Fatalf("round trip: got %q, want %q", dec.(pdf.String), want)
+	}
+}
+
+// TestOutputEncryptionWrongPassword checks that a mismatched password
+// recovers the wrong file key (and so garbage, not the original plaintext),
+// rather than failing outright - the classic RC4-128 handler has no way to
+// validate a password up front.
+func TestOutputEncryptionWrongPassword(t *testing.T) {
+	out, err := newOutputSecurityHandler("hunter2")
+	if err != nil {
+		t.Fatalf("newOutputSecurityHandler: %v", err)
+	}
+	want := pdf.String("top secret")
+	enc, err := encryptObject(out, 3, 0, want)
+	if err != nil {
+		t.Fatalf("encryptObject: %v", err)
+	}
+
+	in, err := newSecurityHandler(out.encryptDict(), out.id0, "wrong password")
+	if err != nil {
+		t.Fatalf("newSecurityHandler: %v", err)
+	}
+	dec, err := decryptObject(in, 3, 0, enc)
+	if err != nil {
+		t.Fatalf("decryptObject: %v", err)
+	}
+	if dec.(pdf.String) == want {
+		t.Fatalf("decrypting with the wrong password still recovered the plaintext")
+	}
+}
+
+// TestHash2B checks the basic properties Algorithm 2.B needs to hold for
+// newSecurityHandler's /R 6 path to be meaningful: deterministic given the
+// same inputs, and sensitive to the password, salt and udata independently.
+func TestHash2B(t *testing.T) {
+	pw, salt, udata := []byte("password"), []byte("12345678"), []byte(nil)
+
+	a := hash2B(pw, salt, udata)
+	b := hash2B(pw, salt, udata)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("hash2B is not deterministic")
+	}
+	if len(a) != 32 {
+		t.Fatalf("hash2B returned %d bytes, want 32", len(a))
+	}
+
+	if bytes.Equal(a, hash2B([]byte("different"), salt, udata)) {
+		t.Fatalf("hash2B ignored the password")
+	}
+	if bytes.Equal(a, hash2B(pw, []byte("87654321"), udata)) {
+		t.Fatalf("hash2B ignored the salt")
+	}
+	if bytes.Equal(a, hash2B(pw, salt, []byte("some /U string"))) {
+		t.Fatalf("hash2B ignored udata")
+	}
+}
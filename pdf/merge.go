@@ -53,7 +53,7 @@ func MergeFiles(dest string, sources ...string) error {
 		closers = append(closers, file)
 
 		var root pdf.Object
-		_, root, err = copyReferencedObjects(map[pdf.ObjectReference]pdf.ObjectReference{}, merged, file, file.Root)
+		_, root, err = copyReferencedObjects(map[pdf.ObjectReference]pdf.ObjectReference{}, merged, file, file.Root, nil, nil, nil)
 		if err != nil {
 			return err
 		}
@@ -85,7 +85,19 @@ func MergeFiles(dest string, sources ...string) error {
 	return merged.Save()
 }
 
-func copyReferencedObjects(refs map[pdf.ObjectReference]pdf.ObjectReference, dst, src *pdf.File, obj pdf.Object) (map[pdf.ObjectReference]pdf.ObjectReference, pdf.Object, error) {
+// copyReferencedObjects copies obj (and, recursively, everything it
+// references) from src into dst, returning the possibly-updated refs map
+// (already-copied source references to their dst equivalents) and the
+// version of obj to store in the copying caller.
+//
+// handler, dedup and outHandler are all optional (nil disables the
+// behavior) and are only ever non-nil when called from
+// MergeFilesWithOptions: handler decrypts each String/Stream read out of
+// src, dedup reuses a previously-copied object that canonicalizes to the
+// same content instead of writing it into dst again, and outHandler
+// re-encrypts what's written into dst. Plain MergeFiles calls this with all
+// three nil.
+func copyReferencedObjects(refs map[pdf.ObjectReference]pdf.ObjectReference, dst, src *pdf.File, obj pdf.Object, handler *securityHandler, dedup *deduper, outHandler *outputSecurityHandler) (map[pdf.ObjectReference]pdf.ObjectReference, pdf.Object, error) {
 	var merge = func(newRefs map[pdf.ObjectReference]pdf.ObjectReference) {
 		for k, v := range newRefs {
 			refs[k] = v
@@ -107,25 +119,48 @@ func copyReferencedObjects(refs map[pdf.ObjectReference]pdf.ObjectReference, dst
 		}
 		refs[t] = ref
 
-		newRefs, newObj, copyErr := copyReferencedObjects(refs, dst, src, src.Get(t))
+		raw := src.Get(t)
+		if handler != nil {
+			var decErr error
+			raw, decErr = decryptObject(handler, t.Number, t.Generation, raw)
+			if decErr != nil {
+				return nil, nil, fmt.Errorf("decrypt %d %d obj: %v", t.Number, t.Generation, decErr)
+			}
+		}
+
+		newRefs, newObj, copyErr := copyReferencedObjects(refs, dst, src, raw, handler, dedup, outHandler)
 		if copyErr != nil {
 			return nil, nil, copyErr
 		}
 		merge(newRefs)
 
-		// now actually add the object to dst
-		if refs[t], err = dst.Add(pdf.IndirectObject{
-			ObjectReference: ref,
-			Object:          newObj,
-		}); err != nil {
-			return nil, nil, err
+		// dedup hashes newObj in its plaintext form, so it must run before
+		// outHandler re-encrypts it: ciphertext for identical plaintext
+		// differs per object number, and would never match across sources.
+		if dedup != nil {
+			if refs[t], err = dedup.addOrReuse(dst, ref, newObj, outHandler); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			if outHandler != nil {
+				if newObj, err = encryptObject(outHandler, ref.Number, ref.Generation, newObj); err != nil {
+					return nil, nil, fmt.Errorf("encrypt %d %d obj: %v", ref.Number, ref.Generation, err)
+				}
+			}
+			// now actually add the object to dst
+			if refs[t], err = dst.Add(pdf.IndirectObject{
+				ObjectReference: ref,
+				Object:          newObj,
+			}); err != nil {
+				return nil, nil, err
+			}
 		}
 
 		obj = refs[t]
 	case pdf.Dictionary:
 		for k, v := range t {
 			var newRefs map[pdf.ObjectReference]pdf.ObjectReference
-			if newRefs, t[k], err = copyReferencedObjects(refs, dst, src, v); err != nil {
+			if newRefs, t[k], err = copyReferencedObjects(refs, dst, src, v, handler, dedup, outHandler); err != nil {
 				return nil, nil, err
 			}
 
@@ -135,7 +170,7 @@ func copyReferencedObjects(refs map[pdf.ObjectReference]pdf.ObjectReference, dst
 	case pdf.Array:
 		for i, v := range t {
 			var newRefs map[pdf.ObjectReference]pdf.ObjectReference
-			if newRefs, t[i], err = copyReferencedObjects(refs, dst, src, v); err != nil {
+			if newRefs, t[i], err = copyReferencedObjects(refs, dst, src, v, handler, dedup, outHandler); err != nil {
 				return nil, nil, err
 			}
 			merge(newRefs)
@@ -144,14 +179,16 @@ func copyReferencedObjects(refs map[pdf.ObjectReference]pdf.ObjectReference, dst
 	case pdf.Stream:
 		for k, v := range t.Dictionary {
 			var newRefs map[pdf.ObjectReference]pdf.ObjectReference
-			if newRefs, t.Dictionary[k], err = copyReferencedObjects(refs, dst, src, v); err != nil {
+			if newRefs, t.Dictionary[k], err = copyReferencedObjects(refs, dst, src, v, handler, dedup, outHandler); err != nil {
 				return nil, nil, err
 			}
 			merge(newRefs)
 		}
 		obj = t
 	case pdf.Name, pdf.Integer, pdf.String, pdf.Real:
-		// these types can't have references
+		// these types can't have references; the string, if any, was
+		// already decrypted by the caller holding the owning object's
+		// number/generation.
 	default:
 		return nil, nil, fmt.Errorf("unhandled %T", obj)
 	}
@@ -0,0 +1,224 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nathankerr/pdf"
+)
+
+// MergeOptions configures MergeFilesWithOptions.
+type MergeOptions struct {
+	// Passwords holds the (user) password to open each source with,
+	// indexed the same way as the sources passed to MergeFilesWithOptions.
+	// Sources that aren't encrypted, or that use the empty password,
+	// can be left out.
+	Passwords map[int]string
+
+	// TargetVersion is the PDF version dest should claim to be, e.g.
+	// "1.7" or "2.0". The zero value means "1.7"; no other value is
+	// accepted. It is written as a /Version entry in the merged Catalog
+	// (ISO 32000-1 7.5.2), which overrides the file header version that
+	// pdf.Create always writes. Encountering AES-256 encryption (/V 5 or
+	// /R 6) or a cross-reference stream (any /Type /XRef trailer, whether or
+	// not its /Index leaves gaps) in a source while targeting 1.7 is not an
+	// error: it's read as usual and logged once via Log, since the merged output itself doesn't carry
+	// that structure forward; targeting 2.0 suppresses that log, since the
+	// feature is native to the declared output version.
+	TargetVersion string
+
+	// OutputPassword, when non-empty, re-encrypts dest with the classic
+	// standard security handler (RC4-128, /V 2 /R 3), using it as both the
+	// user and the owner password. The zero value leaves dest unencrypted,
+	// the only behavior before this field existed. AES output encryption
+	// isn't implemented; a source already using it is still read fine (via
+	// Passwords), it just can't be reproduced on write.
+	OutputPassword string
+
+	// Dedup reuses previously-written dictionaries and streams that are
+	// byte-for-byte identical (after decoding) to one already copied into
+	// dest, instead of writing them again for every source. It costs
+	// extra CPU (every object gets canonicalized and hashed), so it's
+	// opt-in.
+	Dedup bool
+}
+
+var pdf20DisclaimerOnce sync.Once
+
+func warnPDF20Downgrade() {
+	pdf20DisclaimerOnce.Do(func() {
+		Log("msg", "source uses a PDF 2.0-only feature; merging it into a 1.7-compatible output")
+	})
+}
+
+// MergeFilesWithOptions is MergeFiles with support for encrypted sources
+// (via MergeOptions.Passwords), optional content-addressable dedup of
+// repeated resources (via MergeOptions.Dedup), and optional output
+// encryption (via MergeOptions.OutputPassword).
+func MergeFilesWithOptions(dest string, opts MergeOptions, sources ...string) (MergeResult, error) {
+	var result MergeResult
+	targetIsPDF20, err := normalizeTargetVersion(opts.TargetVersion)
+	if err != nil {
+		return result, err
+	}
+
+	merged, err := pdf.Create(dest)
+	if err != nil {
+		return result, fmt.Errorf("create %q: %v", dest, err)
+	}
+
+	closers := make([]io.Closer, 0, len(sources))
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+
+	var dedup *deduper
+	if opts.Dedup {
+		dedup = newDeduper()
+	}
+
+	var outHandler *outputSecurityHandler
+	if opts.OutputPassword != "" {
+		outHandler, err = newOutputSecurityHandler(opts.OutputPassword)
+		if err != nil {
+			return result, fmt.Errorf("set up output encryption: %v", err)
+		}
+	}
+
+	roots := make([]pdf.ObjectReference, 0, len(sources))
+	for i, fn := range sources {
+		file, openErr := pdf.Open(fn)
+		if openErr != nil {
+			return result, fmt.Errorf("open %q: %v", fn, openErr)
+		}
+		closers = append(closers, file)
+
+		if !targetIsPDF20 && usesCrossReferenceStreams(file.Trailer) {
+			warnPDF20Downgrade()
+		}
+
+		handler, handlerErr := fileSecurityHandler(file, opts.Passwords[i], targetIsPDF20)
+		if handlerErr != nil {
+			return result, fmt.Errorf("%q: %v", fn, handlerErr)
+		}
+
+		var root pdf.Object
+		_, root, err = copyReferencedObjects(map[pdf.ObjectReference]pdf.ObjectReference{}, merged, file, file.Root, handler, dedup, outHandler)
+		if err != nil {
+			return result, err
+		}
+		roots = append(roots, root.(pdf.ObjectReference))
+		merged.Root = root.(pdf.ObjectReference)
+	}
+
+	catalogs := make([]pdf.Dictionary, 0, len(roots))
+	for _, root := range roots {
+		catalogs = append(catalogs, merged.Get(root).(pdf.Dictionary))
+	}
+
+	pageTreeRef, err := mergePageTrees(merged, catalogs)
+	if err != nil {
+		return result, err
+	}
+
+	catalog := pdf.Dictionary{
+		"Type":  pdf.Name("Catalog"),
+		"Pages": pageTreeRef,
+	}
+	if targetIsPDF20 {
+		catalog["Version"] = pdf.Name("2.0")
+	} else if opts.TargetVersion != "" {
+		catalog["Version"] = pdf.Name(opts.TargetVersion)
+	}
+	merged.Root, err = merged.Add(catalog)
+	if err != nil {
+		return result, err
+	}
+
+	if outHandler != nil {
+		if merged.Trailer == nil {
+			merged.Trailer = pdf.Dictionary{}
+		}
+		merged.Trailer["Encrypt"] = outHandler.encryptDict()
+		merged.Trailer["ID"] = pdf.Array{pdf.String(outHandler.id0), pdf.String(outHandler.id0)}
+	}
+
+	if err := merged.Save(); err != nil {
+		return result, err
+	}
+	if dedup != nil {
+		result = dedup.result
+	}
+	return result, nil
+}
+
+// normalizeTargetVersion validates MergeOptions.TargetVersion and reports
+// whether it names PDF 2.0.
+func normalizeTargetVersion(version string) (isPDF20 bool, err error) {
+	switch version {
+	case "", "1.7":
+		return false, nil
+	case "2.0":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported MergeOptions.TargetVersion %q (want \"1.7\" or \"2.0\")", version)
+	}
+}
+
+// usesCrossReferenceStreams reports whether trailer is the dictionary of a
+// PDF 1.5+ cross-reference stream (/Type /XRef) rather than a classic
+// trailer. Since a classic cross-reference table cannot point into a
+// compressed object stream, any file using those (what MergeFilesWithOptions
+// silently flattens away) necessarily has one of these as its trailer too.
+func usesCrossReferenceStreams(trailer pdf.Dictionary) bool {
+	t, ok := trailer["Type"].(pdf.Name)
+	return ok && t == "XRef"
+}
+
+// fileSecurityHandler returns the securityHandler needed to read file's
+// strings and streams, or nil if file isn't encrypted.
+func fileSecurityHandler(file *pdf.File, password string, targetIsPDF20 bool) (*securityHandler, error) {
+	encObj, ok := file.Trailer["Encrypt"]
+	if !ok {
+		return nil, nil
+	}
+	encDict, ok := encObj.(pdf.Dictionary)
+	if !ok {
+		if ref, isRef := encObj.(pdf.ObjectReference); isRef {
+			encDict, ok = file.Get(ref).(pdf.Dictionary)
+		}
+		if !ok {
+			return nil, fmt.Errorf("/Encrypt is not a dictionary")
+		}
+	}
+	if !targetIsPDF20 && isPDF20Encryption(encDict) {
+		warnPDF20Downgrade()
+	}
+
+	var id0 []byte
+	if idArr, ok := file.Trailer["ID"].(pdf.Array); ok && len(idArr) > 0 {
+		if s, ok := idArr[0].(pdf.String); ok {
+			id0 = []byte(s)
+		}
+	}
+	return newSecurityHandler(encDict, id0, password)
+}
@@ -0,0 +1,815 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SignOptions controls how SignFile produces the signature.
+type SignOptions struct {
+	// Reason, Name and Location are put into the signature dictionary as-is,
+	// when non-empty.
+	Reason, Name, Location string
+
+	// ContentsSize is the number of bytes reserved for the (hex-encoded)
+	// /Contents placeholder. The DER-encoded PKCS#7 blob must fit into it;
+	// 0 means use a generous default (8192 bytes of DER, i.e. 16384 hex chars).
+	ContentsSize int
+}
+
+const defaultContentsSize = 8192
+
+// SignFile reads src, appends an incremental update that adds an AcroForm
+// signature field covering the whole (pre-signature) file, and writes the
+// result to dest. The signature is a detached PKCS#7/CMS SignedData blob
+// over a SHA-256 digest of the file, as required by a classic
+// Adobe.PPKLite/adbe.pkcs7.detached signature.
+//
+// The original bytes of src are never modified; dest is src plus one
+// incremental update, so any signature already present in src stays valid.
+//
+// SignFile and AppendPages parse src with their own regex/byte-offset
+// scanner rather than the github.com/nathankerr/pdf object model the rest
+// of this package uses, because an incremental update must be built by
+// appending to the exact original bytes, not by re-serializing a parsed
+// File - so a classic "N 0 obj" object and a cross-reference-stream trailer
+// are both understood, but an object compressed inside a /Type /ObjStm
+// object stream (common in PDF 1.5+ files that use cross-reference streams)
+// is not; see findObjectBody.
+func SignFile(dest, src string, signer crypto.Signer, cert *x509.Certificate, opts SignOptions) error {
+	base, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("read %q: %v", src, err)
+	}
+	prevStartxref, size, root, err := parseTrailer(base)
+	if err != nil {
+		return fmt.Errorf("parse trailer of %q: %v", src, err)
+	}
+	pageRef, err := firstPageRef(base, root.pagesRef)
+	if err != nil {
+		return fmt.Errorf("find a page to attach the signature widget to: %v", err)
+	}
+
+	contentsSize := opts.ContentsSize
+	if contentsSize <= 0 {
+		contentsSize = defaultContentsSize
+	}
+
+	sigObj := size // new /Sig object
+	acroFormObj := size + 1
+	fieldObj := size + 2
+	newSize := size + 3
+
+	placeholder := bytes.Repeat([]byte{'0'}, contentsSize*2)
+
+	var buf bytes.Buffer
+	buf.Write(base)
+	if n := buf.Len(); n == 0 || base[n-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	offsets := make(map[int]int64, 3)
+
+	// /Sig signature dictionary, with a placeholder ByteRange: it is
+	// rewritten below once the final offsets are known.
+	offsets[sigObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /adbe.pkcs7.detached\n", sigObj)
+	byteRangeOffset := buf.Len() + len("  /ByteRange [")
+	fmt.Fprintf(&buf, "  /ByteRange [%020d %020d %020d %020d]\n", 0, 0, 0, 0)
+	contentsOffset := buf.Len() + len("  /Contents <")
+	fmt.Fprintf(&buf, "  /Contents <%s>\n", placeholder)
+	if opts.Reason != "" {
+		fmt.Fprintf(&buf, "  /Reason %s\n", pdfString(opts.Reason))
+	}
+	if opts.Name != "" {
+		fmt.Fprintf(&buf, "  /Name %s\n", pdfString(opts.Name))
+	}
+	if opts.Location != "" {
+		fmt.Fprintf(&buf, "  /Location %s\n", pdfString(opts.Location))
+	}
+	buf.WriteString(">>\nendobj\n")
+
+	// /P must name the page the widget appears on (ISO 32000-1 Table 164),
+	// not the Pages tree root: there is no visible widget without one, and
+	// readers that check it reject the file outright.
+	offsets[fieldObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Annot /Subtype /Widget /FT /Sig /Ff 0 /Rect [0 0 0 0]\n  /V %d 0 R /T (Signature1) /P %s >>\nendobj\n",
+		fieldObj, sigObj, pageRef)
+
+	offsets[acroFormObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Fields [%d 0 R] /SigFlags 3 >>\nendobj\n", acroFormObj, fieldObj)
+
+	// updated Catalog: same object number as before, pulled forward with
+	// an added /AcroForm entry.
+	catalogObj := root.ref
+	offsets[catalogObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< %s /AcroForm %d 0 R >>\nendobj\n", catalogObj, root.bodyWithoutDelims, acroFormObj)
+
+	xrefOffset := int64(buf.Len())
+	objNums := []int{sigObj, fieldObj, acroFormObj, catalogObj}
+	buf.WriteString("xref\n")
+	for _, n := range objNums {
+		fmt.Fprintf(&buf, "%d 1\n", n)
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offsets[n])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n",
+		newSize, catalogObj, prevStartxref, xrefOffset)
+
+	out := buf.Bytes()
+
+	// Compute the ByteRange: everything except the hex string inside
+	// /Contents <...>. Both placeholders are spliced in place at their
+	// known, recorded offsets (not searched for), so a run of bytes
+	// elsewhere in the file that happens to look like either placeholder
+	// - plausible in an ASCIIHex stream or padding - can't be patched by
+	// mistake; padded with trailing spaces to its original width, so no
+	// byte offset computed above (or baked into the xref table) shifts.
+	a, b := int64(0), int64(contentsOffset)
+	c, d := int64(contentsOffset+len(placeholder)), int64(len(out))-int64(contentsOffset+len(placeholder))
+	byteRangeWidth := len(fmt.Sprintf("%020d %020d %020d %020d", 0, 0, 0, 0))
+	byteRange := fmt.Sprintf("%d %d %d %d", a, b, c, d)
+	if pad := byteRangeWidth - len(byteRange); pad > 0 {
+		byteRange += string(bytes.Repeat([]byte{' '}, pad))
+	}
+	copy(out[byteRangeOffset:byteRangeOffset+byteRangeWidth], byteRange)
+
+	h := sha256.New()
+	h.Write(out[a:b])
+	h.Write(out[c : c+d])
+	digest := h.Sum(nil)
+
+	der, err := signDetached(digest, signer, cert)
+	if err != nil {
+		return fmt.Errorf("sign: %v", err)
+	}
+	if len(der)*2 > len(placeholder) {
+		return fmt.Errorf("signature (%d bytes DER) does not fit in reserved /Contents (%d bytes); raise SignOptions.ContentsSize", len(der), contentsSize)
+	}
+	const hexDigits = "0123456789abcdef"
+	for i, b := range der {
+		out[contentsOffset+2*i] = hexDigits[b>>4]
+		out[contentsOffset+2*i+1] = hexDigits[b&0x0f]
+	}
+
+	if err := ioutil.WriteFile(dest, out, 0644); err != nil {
+		return fmt.Errorf("write %q: %v", dest, err)
+	}
+	return nil
+}
+
+// signDetached builds a minimal PKCS#7 (CMS) SignedData structure holding a
+// detached signature over digest.
+func signDetached(digest []byte, signer crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	signed, err := signer.Sign(nil, digest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("sign digest: %v", err)
+	}
+
+	sha256OID := asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	rsaEncryptionOID := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	dataOID := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	signedDataOID := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	type algorithmIdentifier struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+	type issuerAndSerial struct {
+		Issuer       asn1.RawValue
+		SerialNumber asn1.RawValue
+	}
+	type signerInfo struct {
+		Version                   int
+		IssuerAndSerialNumber     issuerAndSerial
+		DigestAlgorithm           algorithmIdentifier
+		DigestEncryptionAlgorithm algorithmIdentifier
+		EncryptedDigest           []byte
+	}
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"optional,explicit,tag:0"`
+	}
+	type signedData struct {
+		Version          int
+		DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+		ContentInfo      contentInfo
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+		SignerInfos      []signerInfo  `asn1:"set"`
+	}
+
+	var rawIssuer, rawSerial asn1.RawValue
+	if _, err := asn1.Unmarshal(cert.RawIssuer, &rawIssuer); err != nil {
+		return nil, fmt.Errorf("unmarshal issuer: %v", err)
+	}
+	serialBytes, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return nil, fmt.Errorf("marshal serial: %v", err)
+	}
+	if _, err := asn1.Unmarshal(serialBytes, &rawSerial); err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{{Algorithm: sha256OID}},
+		ContentInfo:      contentInfo{ContentType: dataOID},
+		Certificates:     asn1.RawValue{FullBytes: cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     issuerAndSerial{Issuer: rawIssuer, SerialNumber: rawSerial},
+			DigestAlgorithm:           algorithmIdentifier{Algorithm: sha256OID},
+			DigestEncryptionAlgorithm: algorithmIdentifier{Algorithm: rsaEncryptionOID},
+			EncryptedDigest:           signed,
+		}},
+	}
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("marshal SignedData: %v", err)
+	}
+	ci := struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}{
+		ContentType: signedDataOID,
+		Content:     asn1.RawValue{FullBytes: sdBytes},
+	}
+	return asn1.Marshal(ci)
+}
+
+func pdfString(s string) string {
+	r := make([]byte, 0, len(s)+2)
+	r = append(r, '(')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '(' || c == ')' || c == '\\' {
+			r = append(r, '\\')
+		}
+		r = append(r, c)
+	}
+	r = append(r, ')')
+	return string(r)
+}
+
+// catalogInfo is the subset of a parsed Catalog that SignFile/AppendPages
+// need to build their incremental update.
+type catalogInfo struct {
+	ref               int
+	bodyWithoutDelims string
+	// pagesRef is the Catalog's "/Pages N 0 R" entry, as "N 0 R", or a
+	// reference to the Catalog itself if none was found. It names the
+	// Pages tree root, not an individual page; see firstPageRef for that.
+	pagesRef string
+}
+
+var (
+	startxrefRe       = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF`)
+	sizeRe            = regexp.MustCompile(`/Size\s+(\d+)`)
+	rootRefRe         = regexp.MustCompile(`/Root\s+(\d+)\s+0\s+R`)
+	pagesRefRe        = regexp.MustCompile(`/Pages\s+(\d+)\s+0\s+R`)
+	pagesTypeRe       = regexp.MustCompile(`/Type\s*/Pages\b`)
+	kidsArrayRe       = regexp.MustCompile(`/Kids\s*\[(.*?)\]`)
+	kidRefRe          = regexp.MustCompile(`(\d+)\s+0\s+R`)
+	objHeaderForRefRe = regexp.MustCompile(`^(\d+)\s+0\s+R$`)
+	objHeaderAtRe     = regexp.MustCompile(`^\s*\d+\s+\d+\s+obj\b`)
+	xrefStreamTypeRe  = regexp.MustCompile(`/Type\s*/XRef\b`)
+	objStmTypeRe      = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	lengthRefRe       = regexp.MustCompile(`/Length\s+(\d+)\s+0\s+R`)
+	lengthIntRe       = regexp.MustCompile(`/Length\s+(-?\d+)`)
+	indirectRefRe     = regexp.MustCompile(`(\d+) 0 R`)
+)
+
+// isPDFSpace reports whether b is PDF whitespace (ISO 32000-1 Table 1).
+func isPDFSpace(b byte) bool {
+	switch b {
+	case 0x00, 0x09, 0x0A, 0x0C, 0x0D, 0x20:
+		return true
+	}
+	return false
+}
+
+// extractDict parses the dictionary starting at data[pos:pos+2] == "<<",
+// returning its content without the delimiters and the offset right after
+// the matching ">>". Unlike a non-greedy regex, it tracks nesting depth
+// (and skips over literal/hex strings, so a "<<" or ">>" inside a string
+// value doesn't desynchronize it), so a dictionary containing another
+// dictionary - /ViewerPreferences, /MarkInfo, /Names, all common in a
+// Catalog - is never truncated mid-body.
+func extractDict(data []byte, pos int) (body string, end int, err error) {
+	if pos+1 >= len(data) || data[pos] != '<' || data[pos+1] != '<' {
+		return "", pos, fmt.Errorf("no dictionary at offset %d", pos)
+	}
+	start := pos + 2
+	depth := 1
+	i := start
+	for i < len(data) {
+		switch {
+		case i+1 < len(data) && data[i] == '<' && data[i+1] == '<':
+			depth++
+			i += 2
+		case i+1 < len(data) && data[i] == '>' && data[i+1] == '>':
+			depth--
+			i += 2
+			if depth == 0 {
+				return string(data[start : i-2]), i, nil
+			}
+		case data[i] == '(':
+			i = skipLiteralString(data, i)
+		case data[i] == '<':
+			i = skipHexString(data, i)
+		default:
+			i++
+		}
+	}
+	return "", pos, fmt.Errorf("unbalanced dictionary starting at offset %d", pos)
+}
+
+// skipLiteralString returns the offset right after the "(...)" string
+// starting at data[i], honoring nested (unescaped) parens and backslash
+// escapes, per ISO 32000-1 7.3.4.2.
+func skipLiteralString(data []byte, i int) int {
+	depth := 0
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++ // skip the escaped byte, whatever it is
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// skipHexString returns the offset right after the "<...>" hex string
+// starting at data[i] (a single '<', already known not to be "<<").
+func skipHexString(data []byte, i int) int {
+	for ; i < len(data); i++ {
+		if data[i] == '>' {
+			return i + 1
+		}
+	}
+	return i
+}
+
+// findObjectBody locates the last "N 0 obj" header for num and returns its
+// dictionary body (without delimiters). Like the rest of this file, it only
+// ever looks for generation 0, which is all SignFile/AppendPages ever write
+// or expect to find.
+//
+// It only ever finds an object written out with its own "N 0 obj" header; a
+// PDF 1.5+ file is free to store objects compressed inside a /Type /ObjStm
+// object stream instead (referenced from a cross-reference stream by a type
+// 2 entry), and this byte-offset scanner has no decompressor for that. If
+// num isn't found and the file contains at least one /ObjStm, that's almost
+// certainly why, so the error says so instead of leaving the caller to guess.
+func findObjectBody(data []byte, num int) (string, error) {
+	re := regexp.MustCompile(fmt.Sprintf(`(?:^|[^0-9])%d 0 obj`, num))
+	locs := re.FindAllIndex(data, -1)
+	if locs == nil {
+		if objStmTypeRe.Match(data) {
+			return "", fmt.Errorf("object %d not found (likely stored in a compressed object stream, /Type /ObjStm, which SignFile/AppendPages can't read)", num)
+		}
+		return "", fmt.Errorf("object %d not found", num)
+	}
+	p := locs[len(locs)-1][1]
+	for p < len(data) && isPDFSpace(data[p]) {
+		p++
+	}
+	body, _, err := extractDict(data, p)
+	if err != nil {
+		return "", fmt.Errorf("object %d: %v", num, err)
+	}
+	return body, nil
+}
+
+// firstLeafPage resolves ref (an object number, expected to be a Pages node
+// or a Page) down to the first actual Page object under it, descending
+// /Kids as needed.
+func firstLeafPage(data []byte, ref int, seen map[int]bool) (int, error) {
+	if seen[ref] {
+		return 0, fmt.Errorf("cyclic page tree at object %d", ref)
+	}
+	seen[ref] = true
+	body, err := findObjectBody(data, ref)
+	if err != nil {
+		return 0, err
+	}
+	if !pagesTypeRe.MatchString(body) {
+		// not a /Pages node, so it must be the page itself
+		return ref, nil
+	}
+	kids := kidsArrayRe.FindStringSubmatch(body)
+	if kids == nil {
+		return 0, fmt.Errorf("/Pages object %d has no /Kids", ref)
+	}
+	kidRefs := kidRefRe.FindAllStringSubmatch(kids[1], -1)
+	if len(kidRefs) == 0 {
+		return 0, fmt.Errorf("/Pages object %d has an empty /Kids", ref)
+	}
+	first, err := strconv.Atoi(kidRefs[0][1])
+	if err != nil {
+		return 0, err
+	}
+	return firstLeafPage(data, first, seen)
+}
+
+// firstPageRef resolves pagesRef - a "N 0 R" reference to a Pages tree
+// root - to the first Page object under it, as a "N 0 R" reference, for use
+// as an annotation's /P (ISO 32000-1 Table 164 requires it to name a page,
+// not the Pages tree root).
+func firstPageRef(data []byte, pagesRef string) (string, error) {
+	m := objHeaderForRefRe.FindStringSubmatch(strings.TrimSpace(pagesRef))
+	if m == nil {
+		return "", fmt.Errorf("malformed reference %q", pagesRef)
+	}
+	num, err := strconv.Atoi(m[1])
+	if err != nil {
+		return "", err
+	}
+	leaf, err := firstLeafPage(data, num, map[int]bool{})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d 0 R", leaf), nil
+}
+
+// trailerDict locates the trailer dictionary belonging to the most recent
+// cross-reference section: either a classic "trailer" keyword, or (PDF
+// 1.5+) the dictionary of the cross-reference stream object startxref
+// points directly at, identified by /Type /XRef.
+func trailerDict(data []byte, startxref int64) (string, error) {
+	inRange := startxref >= 0 && int(startxref) < len(data)
+	if !inRange || objHeaderAtRe.Find(data[startxref:]) == nil {
+		if idx := bytes.LastIndex(data, []byte("trailer")); idx >= 0 {
+			p := idx + len("trailer")
+			for p < len(data) && isPDFSpace(data[p]) {
+				p++
+			}
+			if body, _, err := extractDict(data, p); err == nil {
+				return body, nil
+			}
+		}
+	}
+
+	if !inRange {
+		return "", fmt.Errorf("startxref %d out of range", startxref)
+	}
+	head := data[startxref:]
+	hdr := objHeaderAtRe.Find(head)
+	if hdr == nil {
+		return "", fmt.Errorf("no trailer, and no cross-reference stream object, at offset %d", startxref)
+	}
+	p := int(startxref) + len(hdr)
+	for p < len(data) && isPDFSpace(data[p]) {
+		p++
+	}
+	body, _, err := extractDict(data, p)
+	if err != nil {
+		return "", fmt.Errorf("cross-reference stream at offset %d: %v", startxref, err)
+	}
+	if !xrefStreamTypeRe.MatchString(body) {
+		return "", fmt.Errorf("object at offset %d is neither a trailer nor a /Type /XRef stream", startxref)
+	}
+	return body, nil
+}
+
+// parseTrailer extracts the last startxref offset, the object count (/Size)
+// and the Catalog (/Root) object from the file's most recent trailer, so an
+// incremental update can be appended after it. Both a classic trailer and a
+// PDF 1.5+ cross-reference stream are understood (see trailerDict).
+func parseTrailer(data []byte) (prevStartxref int64, size int, cat catalogInfo, err error) {
+	matches := startxrefRe.FindAllSubmatch(data, -1)
+	if len(matches) == 0 {
+		return 0, 0, cat, fmt.Errorf("no startxref found")
+	}
+	last := matches[len(matches)-1]
+	prevStartxref, err = strconv.ParseInt(string(last[1]), 10, 64)
+	if err != nil {
+		return 0, 0, cat, err
+	}
+
+	trailer, err := trailerDict(data, prevStartxref)
+	if err != nil {
+		return 0, 0, cat, err
+	}
+
+	sm := sizeRe.FindStringSubmatch(trailer)
+	if sm == nil {
+		return 0, 0, cat, fmt.Errorf("no /Size in trailer")
+	}
+	size, err = strconv.Atoi(sm[1])
+	if err != nil {
+		return 0, 0, cat, err
+	}
+	rm := rootRefRe.FindStringSubmatch(trailer)
+	if rm == nil {
+		return 0, 0, cat, fmt.Errorf("no /Root in trailer")
+	}
+	cat.ref, err = strconv.Atoi(rm[1])
+	if err != nil {
+		return 0, 0, cat, err
+	}
+
+	body, err := findObjectBody(data, cat.ref)
+	if err != nil {
+		return 0, 0, cat, fmt.Errorf("catalog object %d: %v", cat.ref, err)
+	}
+	cat.bodyWithoutDelims = strings.TrimSpace(body)
+	if pm := pagesRefRe.FindStringSubmatch(cat.bodyWithoutDelims); pm != nil {
+		cat.pagesRef = pm[1] + " 0 R"
+	} else {
+		cat.pagesRef = fmt.Sprintf("%d 0 R", cat.ref)
+	}
+	return prevStartxref, size, cat, nil
+}
+
+// indirectObj is one "N 0 obj ... endobj" parsed out of a PDF by
+// scanIndirectObjects: either a dictionary (optionally with a stream) or,
+// for the occasional bare object (e.g. an indirect /Length target), its raw
+// body text.
+type indirectObj struct {
+	num         int
+	dict        string // dictionary content without delimiters, if any
+	stream      []byte // raw (still-encoded) stream bytes, if any
+	nonDictBody string // raw body text, for objects that aren't dictionaries
+}
+
+// scanIndirectObjects walks every "N 0 obj" in data and parses it fully,
+// respecting /Length for any stream instead of searching for the next
+// literal "endobj" - which, unlike for a plain dictionary object, would be
+// unsound for a stream: binary image/font data (exactly what a merge
+// commonly embeds) can coincidentally contain the ASCII bytes "endobj" and
+// truncate the match.
+func scanIndirectObjects(data []byte) ([]indirectObj, error) {
+	headerRe := regexp.MustCompile(`(\d+)\s+0\s+obj\b`)
+	locs := headerRe.FindAllSubmatchIndex(data, -1)
+	objs := make([]indirectObj, 0, len(locs))
+	for _, loc := range locs {
+		num, err := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		if err != nil {
+			return nil, err
+		}
+		p := loc[1]
+		for p < len(data) && isPDFSpace(data[p]) {
+			p++
+		}
+
+		var obj indirectObj
+		obj.num = num
+
+		if p+1 < len(data) && data[p] == '<' && data[p+1] == '<' {
+			dict, dictEnd, err := extractDict(data, p)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %v", num, err)
+			}
+			obj.dict = dict
+
+			q := dictEnd
+			for q < len(data) && isPDFSpace(data[q]) {
+				q++
+			}
+			if bytes.HasPrefix(data[q:], []byte("stream")) {
+				q += len("stream")
+				// exactly one CRLF or LF follows "stream" (ISO 32000-1 7.3.8.1)
+				switch {
+				case q+1 < len(data) && data[q] == '\r' && data[q+1] == '\n':
+					q += 2
+				case q < len(data) && data[q] == '\n':
+					q++
+				}
+				length, err := streamLength(data, dict)
+				if err != nil {
+					return nil, fmt.Errorf("object %d: %v", num, err)
+				}
+				if q+length > len(data) {
+					return nil, fmt.Errorf("object %d: /Length %d runs past end of file", num, length)
+				}
+				obj.stream = data[q : q+length]
+				q += length
+				for q < len(data) && isPDFSpace(data[q]) {
+					q++
+				}
+				if !bytes.HasPrefix(data[q:], []byte("endstream")) {
+					return nil, fmt.Errorf("object %d: expected endstream after a %d-byte stream", num, length)
+				}
+				q += len("endstream")
+			}
+			for q < len(data) && isPDFSpace(data[q]) {
+				q++
+			}
+			if !bytes.HasPrefix(data[q:], []byte("endobj")) {
+				return nil, fmt.Errorf("object %d: expected endobj", num)
+			}
+		} else {
+			// a bare (non-dictionary) object - e.g. the Integer an indirect
+			// /Length points at - can't embed arbitrary binary, so scanning
+			// for the next literal "endobj" is safe here.
+			idx := bytes.Index(data[p:], []byte("endobj"))
+			if idx < 0 {
+				return nil, fmt.Errorf("object %d: no endobj found", num)
+			}
+			obj.nonDictBody = string(bytes.TrimSpace(data[p : p+idx]))
+		}
+
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// streamLength resolves the /Length entry of dict, following an indirect
+// reference if necessary.
+func streamLength(data []byte, dict string) (int, error) {
+	if m := lengthRefRe.FindStringSubmatch(dict); m != nil {
+		num, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+		n, err := findIntegerObject(data, num)
+		if err != nil {
+			return 0, fmt.Errorf("resolve indirect /Length %d 0 R: %v", num, err)
+		}
+		return n, nil
+	}
+	if m := lengthIntRe.FindStringSubmatch(dict); m != nil {
+		return strconv.Atoi(m[1])
+	}
+	return 0, fmt.Errorf("no /Length in stream dictionary")
+}
+
+// findIntegerObject reads the (non-indirect) integer value of the bare
+// object "num 0 obj N endobj".
+func findIntegerObject(data []byte, num int) (int, error) {
+	re := regexp.MustCompile(fmt.Sprintf(`(?:^|[^0-9])%d 0 obj\s*(-?\d+)\s*endobj`, num))
+	m := re.FindSubmatch(data)
+	if m == nil {
+		if objStmTypeRe.Match(data) {
+			return 0, fmt.Errorf("integer object %d not found (likely stored in a compressed object stream, /Type /ObjStm, which SignFile/AppendPages can't read)", num)
+		}
+		return 0, fmt.Errorf("integer object %d not found", num)
+	}
+	return strconv.Atoi(string(m[1]))
+}
+
+// AppendPages appends the pages of extra to base using an incremental
+// update, writing the result to dest. Unlike MergeFiles, it never rewrites
+// the existing bytes of base, so any signature already present in base (see
+// SignFile) remains valid for the portion of dest it covers.
+func AppendPages(dest, base string, extra ...string) error {
+	data, err := ioutil.ReadFile(base)
+	if err != nil {
+		return fmt.Errorf("read %q: %v", base, err)
+	}
+	prevStartxref, size, cat, err := parseTrailer(data)
+	if err != nil {
+		return fmt.Errorf("parse trailer of %q: %v", base, err)
+	}
+
+	// merge the extra files on their own, the same way MergeFiles would,
+	// then fold the resulting objects into base's incremental update.
+	tmp, err := ioutil.TempFile("", "AppendPages-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpName)
+	if err := MergeFiles(tmpName, extra...); err != nil {
+		return fmt.Errorf("merge %v: %v", extra, err)
+	}
+	tmpData, err := ioutil.ReadFile(tmpName)
+	if err != nil {
+		return err
+	}
+	_, _, tmpCat, err := parseTrailer(tmpData)
+	if err != nil {
+		return fmt.Errorf("parse trailer of merged extra pages: %v", err)
+	}
+	tmpPagesRef, err := dictRef(tmpCat.bodyWithoutDelims, "Pages")
+	if err != nil {
+		return fmt.Errorf("merged extra pages: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data)
+	if n := buf.Len(); n == 0 || data[n-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	// renumber every object from the merged extra file and append it,
+	// starting right after base's highest object number.
+	objs, err := scanIndirectObjects(tmpData)
+	if err != nil {
+		return fmt.Errorf("parse merged extra pages: %v", err)
+	}
+	renumber := make(map[int]int, len(objs))
+	nextObj := size
+	for _, o := range objs {
+		renumber[o.num] = nextObj
+		nextObj++
+	}
+	renumberRefs := func(s string) string {
+		return indirectRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+			old, _ := strconv.Atoi(indirectRefRe.FindStringSubmatch(ref)[1])
+			if mapped, ok := renumber[old]; ok {
+				return fmt.Sprintf("%d 0 R", mapped)
+			}
+			return ref
+		})
+	}
+
+	offsets := make(map[int]int64, len(objs))
+	for _, o := range objs {
+		newNum := renumber[o.num]
+		offsets[newNum] = int64(buf.Len())
+		switch {
+		case o.stream != nil:
+			// references are only rewritten in the dictionary: the raw
+			// stream bytes are copied verbatim, never regexed over, so a
+			// coincidental "N 0 R"-shaped byte sequence in binary image or
+			// font data can't be corrupted.
+			fmt.Fprintf(&buf, "%d 0 obj\n<<%s>>\nstream\n", newNum, renumberRefs(o.dict))
+			buf.Write(o.stream)
+			buf.WriteString("\nendstream\nendobj\n")
+		case o.dict != "":
+			fmt.Fprintf(&buf, "%d 0 obj\n<<%s>>\nendobj\n", newNum, renumberRefs(o.dict))
+		default:
+			fmt.Fprintf(&buf, "%d 0 obj %s endobj\n", newNum, renumberRefs(o.nonDictBody))
+		}
+	}
+	newPagesKid := fmt.Sprintf("%d 0 R", renumber[tmpPagesRef])
+
+	pagesObj := nextObj
+	nextObj++
+	catalogObj := cat.ref
+
+	offsets[pagesObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Pages /Kids [%s %s] /Parent %d 0 R >>\nendobj\n",
+		pagesObj, cat.pagesRef, newPagesKid, catalogObj)
+
+	offsets[catalogObj] = int64(buf.Len())
+	fmt.Fprintf(&buf, "%d 0 obj\n<< %s >>\nendobj\n", catalogObj, replacePages(cat.bodyWithoutDelims, pagesObj))
+
+	xrefOffset := int64(buf.Len())
+	buf.WriteString("xref\n")
+	objNums := make([]int, 0, len(offsets))
+	for n := range offsets {
+		objNums = append(objNums, n)
+	}
+	sort.Ints(objNums)
+	for _, n := range objNums {
+		fmt.Fprintf(&buf, "%d 1\n%010d 00000 n \n", n, offsets[n])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n",
+		nextObj, catalogObj, prevStartxref, xrefOffset)
+
+	return ioutil.WriteFile(dest, buf.Bytes(), 0644)
+}
+
+// dictRef extracts the object number that name refers to in a raw
+// "/Key value /Key2 value2" dictionary body.
+func dictRef(body, name string) (int, error) {
+	m := regexp.MustCompile(`/` + name + `\s+(\d+)\s+0\s+R`).FindStringSubmatch(body)
+	if m == nil {
+		return 0, fmt.Errorf("no /%s reference found", name)
+	}
+	return strconv.Atoi(m[1])
+}
+
+func replacePages(body string, pagesObj int) string {
+	re := regexp.MustCompile(`/Pages\s+\d+\s+0\s+R`)
+	replacement := fmt.Sprintf("/Pages %d 0 R", pagesObj)
+	if re.MatchString(body) {
+		return re.ReplaceAllString(body, replacement)
+	}
+	return body + " " + replacement
+}
@@ -0,0 +1,106 @@
+/*
+  Copyright 2017 Tamás Gulácsi
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package pdf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSkipLiteralString(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int // offset right after the closing paren
+	}{
+		{`(a(b)c)rest`, len(`(a(b)c)`)},
+		{`(a\)b)rest`, len(`(a\)b)`)},
+		{`()rest`, len(`()`)},
+	}
+	for _, c := range cases {
+		data := []byte(c.in)
+		if got := skipLiteralString(data, 0); got != c.want {
+			t.Errorf("skipLiteralString(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestExtractDict(t *testing.T) {
+	data := []byte("<< /A << /B 1 >> /C (text with << and >> inside) /D <48656C6C6F> >>REST")
+	body, end, err := extractDict(data, 0)
+	if err != nil {
+		t.Fatalf("extractDict: %v", err)
+	}
+	if !strings.HasSuffix(string(data[:end]), ">>") {
+		t.Errorf("end %d does not land right after the matching '>>': %q", end, data[:end])
+	}
+	if !strings.Contains(body, "/B 1") || !strings.Contains(body, "/D <48656C6C6F>") {
+		t.Errorf("extractDict lost part of a nested dictionary or hex string: %q", body)
+	}
+	if !strings.HasPrefix(string(data[end:]), "REST") {
+		t.Errorf("extractDict did not stop at the outer dictionary's '>>': left %q", data[end:])
+	}
+}
+
+func TestExtractDictUnbalanced(t *testing.T) {
+	if _, _, err := extractDict([]byte("<< /A 1 "), 0); err == nil {
+		t.Fatalf("extractDict accepted an unbalanced dictionary")
+	}
+}
+
+func TestParseTrailer(t *testing.T) {
+	data := []byte("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+		"trailer\n<< /Size 4 /Root 1 0 R >>\nstartxref\n9999\n%%EOF\n")
+
+	prevStartxref, size, cat, err := parseTrailer(data)
+	if err != nil {
+		t.Fatalf("parseTrailer: %v", err)
+	}
+	if prevStartxref != 9999 {
+		t.Errorf("prevStartxref = %d, want 9999", prevStartxref)
+	}
+	if size != 4 {
+		t.Errorf("size = %d, want 4", size)
+	}
+	if cat.ref != 1 {
+		t.Errorf("cat.ref = %d, want 1", cat.ref)
+	}
+	if cat.pagesRef != "2 0 R" {
+		t.Errorf("cat.pagesRef = %q, want \"2 0 R\"", cat.pagesRef)
+	}
+}
+
+func TestFindObjectBodyReportsObjStm(t *testing.T) {
+	data := []byte("1 0 obj\n<< /Type /ObjStm /N 1 /First 8 /Length 5 >>\nstream\nAAAAA\nendstream\nendobj\n")
+	_, err := findObjectBody(data, 99)
+	if err == nil {
+		t.Fatalf("findObjectBody found a nonexistent object")
+	}
+	if !strings.Contains(err.Error(), "ObjStm") {
+		t.Errorf("error %q doesn't mention ObjStm even though the file has one", err)
+	}
+}
+
+func TestFindObjectBodyNotFound(t *testing.T) {
+	_, err := findObjectBody([]byte("1 0 obj\n<< /Type /Catalog >>\nendobj\n"), 99)
+	if err == nil {
+		t.Fatalf("findObjectBody found a nonexistent object")
+	}
+	if strings.Contains(err.Error(), "ObjStm") {
+		t.Errorf("error %q mentions ObjStm even though the file has none", err)
+	}
+}